@@ -4,8 +4,15 @@ go 1.15
 
 require (
 	github.com/apex/log v1.9.0
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/websocket v1.4.2
+	github.com/hanwen/go-fuse/v2 v2.9.0
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.1.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/net v0.11.0
+	golang.org/x/time v0.5.0
+	lukechampine.com/blake3 v1.1.7
 )
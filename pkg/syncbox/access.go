@@ -0,0 +1,198 @@
+package syncbox
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// StateDir is the directory under a synced root where syncbox keeps its own
+// bookkeeping. It is never synced.
+const StateDir = ".syncbox"
+
+// Access authenticates users and decides what they may do with a path. When
+// no users are configured every request is anonymous and allowed everything.
+type Access struct {
+	users  map[string]string
+	shares *ShareStore
+	quotas *Quotas
+}
+
+func NewAccess(users map[string]string, shares *ShareStore, quotas *Quotas) *Access {
+	return &Access{
+		users:  users,
+		shares: shares,
+		quotas: quotas,
+	}
+}
+
+// LoadUsers reads a json object of user name to password.
+func LoadUsers(path string) (map[string]string, error) {
+	var users = make(map[string]string)
+	if path == "" {
+		return users, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (a *Access) Enabled() bool {
+	return len(a.users) > 0
+}
+
+// Authenticate returns the user of the request's basic auth credentials.
+func (a *Access) Authenticate(r *http.Request) (string, bool) {
+	if !a.Enabled() {
+		return "", true
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	expected, ok := a.users[user]
+	if !ok {
+		return "", false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		return "", false
+	}
+
+	return user, true
+}
+
+func (a *Access) Permission(user string, fullName string) Permission {
+	if !a.Enabled() {
+		return ReadWrite
+	}
+
+	return a.shares.Permission(user, FolderOf(fullName))
+}
+
+// Claim makes user the owner of the folder of fullName if nobody owns it yet.
+func (a *Access) Claim(user string, fullName string) error {
+	if !a.Enabled() {
+		return nil
+	}
+
+	return a.shares.Claim(user, FolderOf(fullName))
+}
+
+func (a *Access) CheckQuota(fileWatcher *FileWatcher, user string, fullName string, size int64) error {
+	return a.quotas.Check(fileWatcher, a.shares, user, fullName, size)
+}
+
+// QuotaLimited tells whether a quota applies to user writing fullName.
+func (a *Access) QuotaLimited(user string, fullName string) bool {
+	return a.quotas.Limited(a.shares, user, fullName)
+}
+
+// Status reports the usage of user and of every folder user could access.
+func (a *Access) Status(fileWatcher *FileWatcher, user string) Status {
+	var status = Status{
+		User:    a.quotas.UserUsage(fileWatcher, a.shares, user),
+		Folders: []Usage{},
+	}
+
+	for _, folder := range a.shares.Folders(user) {
+		status.Folders = append(status.Folders, a.quotas.FolderUsage(fileWatcher, folder))
+	}
+
+	return status
+}
+
+// Folders returns the shared folders user could access.
+func (a *Access) Folders(user string) []string {
+	return a.shares.Folders(user)
+}
+
+// Grant gives user perm on a top level folder owner owns. A folder nobody owns
+// is claimed by owner only if it does not exist yet, others could be using it.
+func (a *Access) Grant(fileWatcher *FileWatcher, owner string, folder string, user string, perm Permission) error {
+	name, ok := cleanName(folder)
+	if !ok || FolderOf(name+"/") != strings.TrimPrefix(name, "/") {
+		return errors.New("only top level folders could be shared")
+	}
+	folder = FolderOf(name + "/")
+
+	if a.shares.Owner(folder) == "" {
+		if _, err := os.Lstat(fileWatcher.path + name); !os.IsNotExist(err) {
+			return ErrNotOwner
+		}
+	}
+
+	return a.shares.Grant(owner, folder, user, perm)
+}
+
+// FolderOf returns the top level folder of a full file name, e.g. "project"
+// for "/project/docs/a.txt". Files directly under the root belong to "".
+func FolderOf(fullName string) string {
+	var name = strings.TrimPrefix(path.Clean("/"+fullName), "/")
+	if strings.HasSuffix(fullName, "/") {
+		// directories are named with a trailing slash, see accessName
+		name += "/"
+	}
+	var i = strings.Index(name, "/")
+	if i < 0 {
+		return ""
+	}
+
+	return name[:i]
+}
+
+// ErrInvalidName refuses a name sent by a client outside the synced files.
+var ErrInvalidName = errors.New("invalid name")
+
+// cleanName returns a full name sent by a client as an absolute name under
+// the root, and false for names with a ".." part, of the root itself or in
+// the state directory.
+func cleanName(fullName string) (string, bool) {
+	for _, part := range strings.Split(fullName, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+
+	fullName = path.Clean("/" + fullName)
+	if fullName == "/" {
+		return "", false
+	}
+
+	for _, part := range strings.Split(fullName, "/") {
+		if part == StateDir {
+			return "", false
+		}
+	}
+
+	return fullName, true
+}
+
+func stateDirPath(root string) string {
+	return root + "/" + StateDir
+}
+
+func ensureStateDir(root string) (string, error) {
+	var dir = stateDirPath(root)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
@@ -0,0 +1,283 @@
+package syncbox
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// limitChunk is the most a limited transfer moves at once, so that slow
+// limits are smooth.
+const limitChunk = 32 * 1024
+
+// Schedule is a bandwidth limit in bytes per second which could change by
+// the time of day, e.g. "1M,09:00-18:00=256K" limits to 256 KiB/s during
+// office hours and to 1 MiB/s otherwise. Zero is unlimited.
+type Schedule struct {
+	Rate    int64
+	Windows []Window
+}
+
+// Window is a time of day from Start to End since midnight, which wraps
+// around midnight if End is before Start.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+	Rate  int64
+}
+
+func ParseSchedule(s string) (Schedule, error) {
+	var schedule Schedule
+	if s == "" {
+		return schedule, nil
+	}
+
+	for i, part := range strings.Split(s, ",") {
+		var spec, limit = "", strings.TrimSpace(part)
+		if j := strings.Index(part, "="); j >= 0 {
+			spec, limit = strings.TrimSpace(part[:j]), strings.TrimSpace(part[j+1:])
+		}
+
+		r, err := ParseRate(limit)
+		if err != nil {
+			return schedule, err
+		}
+
+		if spec == "" {
+			if i > 0 {
+				return schedule, errors.Errorf("bandwidth limit %q has to come before the time windows", part)
+			}
+			schedule.Rate = r
+			continue
+		}
+
+		var times = strings.Split(spec, "-")
+		if len(times) != 2 {
+			return schedule, errors.Errorf("bad time window %q, expect e.g. 09:00-18:00", spec)
+		}
+
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return schedule, err
+		}
+
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return schedule, err
+		}
+
+		schedule.Windows = append(schedule.Windows, Window{Start: start, End: end, Rate: r})
+	}
+
+	return schedule, nil
+}
+
+// ParseRate parses bytes per second, with an optional K, M or G suffix in
+// powers of 1024.
+func ParseRate(s string) (int64, error) {
+	var number = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "/S"), "B")
+	var unit int64 = 1
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+	}
+	if unit > 1 {
+		number = number[:len(number)-1]
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("bad bandwidth limit %q, expect bytes per second e.g. 512K or 2M", s)
+	}
+
+	return int64(n * float64(unit)), nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, errors.Errorf("bad time of day %q, expect e.g. 09:00", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// At returns the limit at t, of the first window t is in.
+func (s Schedule) At(t time.Time) int64 {
+	var midnight = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	var now = t.Sub(midnight)
+	for _, window := range s.Windows {
+		var in = now >= window.Start && now < window.End
+		if window.End <= window.Start {
+			in = now >= window.Start || now < window.End
+		}
+
+		if in {
+			return window.Rate
+		}
+	}
+
+	return s.Rate
+}
+
+// Limiter is a token bucket following a Schedule, with room for a second of
+// transfers. A nil Limiter does not limit.
+type Limiter struct {
+	mu       sync.Mutex
+	schedule Schedule
+	rate     int64
+	limiter  *rate.Limiter
+}
+
+func NewLimiter(schedule Schedule) *Limiter {
+	return &Limiter{
+		schedule: schedule,
+		limiter:  rate.NewLimiter(rate.Inf, 0),
+	}
+}
+
+// Rate returns the limit now in bytes per second, zero if unlimited.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.update(time.Now())
+	return l.rate
+}
+
+// update follows the schedule to the limit at now.
+//
+// must hold the lock
+func (l *Limiter) update(now time.Time) {
+	var r = l.schedule.At(now)
+	if r == l.rate {
+		return
+	}
+
+	l.rate = r
+	if r <= 0 {
+		l.limiter.SetLimitAt(now, rate.Inf)
+		return
+	}
+
+	var burst = int(r)
+	if burst < limitChunk {
+		burst = limitChunk
+	}
+
+	l.limiter.SetLimitAt(now, rate.Limit(r))
+	l.limiter.SetBurstAt(now, burst)
+}
+
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	l.update(time.Now())
+	l.mu.Unlock()
+
+	return l.limiter.WaitN(ctx, n)
+}
+
+type limitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// limitReader throttles reads from r to all of limiters.
+func limitReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > limitChunk {
+		p = p[:limitChunk]
+	}
+
+	n, err := r.r.Read(p)
+	for _, limiter := range r.limiters {
+		if werr := limiter.wait(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+
+	return n, err
+}
+
+// limitedResponseWriter throttles the body of a response to all of limiters.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*Limiter
+}
+
+func (w *limitedResponseWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		var chunk = p
+		if len(chunk) > limitChunk {
+			chunk = chunk[:limitChunk]
+		}
+
+		for _, limiter := range w.limiters {
+			if err := limiter.wait(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Limits are the bandwidth limits of a server, for all transfers together
+// and for each connection. Uploads are what clients send.
+type Limits struct {
+	Upload       Schedule
+	Download     Schedule
+	ConnUpload   Schedule
+	ConnDownload Schedule
+}
+
+// BandwidthStatus reports the bandwidth limits in bytes per second now, zero
+// for unlimited.
+type BandwidthStatus struct {
+	Upload       int64 `json:"upload"`
+	Download     int64 `json:"download"`
+	ConnUpload   int64 `json:"conn_upload"`
+	ConnDownload int64 `json:"conn_download"`
+}
+
+// connLimiters are the limiters of one connection to a server.
+type connLimiters struct {
+	upload   *Limiter
+	download *Limiter
+}
+
+type connLimitersKey struct{}
@@ -0,0 +1,156 @@
+package syncbox
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+)
+
+// Cache keeps the contents of files by checksum under a directory, and
+// evicts the least recently used ones beyond its size limit. Contents in use
+// are never evicted.
+type Cache struct {
+	mu      sync.Mutex
+	dir     string
+	limit   int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	checksum string
+	size     int64
+	pins     int
+}
+
+func NewCache(dir string, limit int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var c = &Cache{
+		dir:     dir,
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the contents kept from before, least recently used first
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		// left by writes which never finished
+		if strings.HasSuffix(info.Name(), ".tmp") {
+			os.Remove(c.path(info.Name()))
+			continue
+		}
+
+		c.entries[info.Name()] = c.lru.PushFront(&cacheEntry{checksum: info.Name(), size: info.Size()})
+		c.size += info.Size()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+
+	return c, nil
+}
+
+func (c *Cache) path(checksum string) string {
+	return c.dir + "/" + checksum
+}
+
+// TempFile creates a file in the cache directory, which Put takes in.
+func (c *Cache) TempFile() (*os.File, error) {
+	return ioutil.TempFile(c.dir, "*.tmp")
+}
+
+// Get pins the content of checksum and returns its path, if it is cached.
+func (c *Cache) Get(checksum string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[checksum]
+	if !ok {
+		return "", false
+	}
+
+	elem.Value.(*cacheEntry).pins++
+	c.lru.MoveToFront(elem)
+	return c.path(checksum), true
+}
+
+// Put moves the file at tmp into the cache as the content of checksum, and
+// returns its path pinned.
+func (c *Cache) Put(checksum string, tmp string) (string, error) {
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[checksum]; ok {
+		os.Remove(tmp)
+		elem.Value.(*cacheEntry).pins++
+		c.lru.MoveToFront(elem)
+		return c.path(checksum), nil
+	}
+
+	if err := os.Rename(tmp, c.path(checksum)); err != nil {
+		return "", err
+	}
+
+	c.entries[checksum] = c.lru.PushFront(&cacheEntry{checksum: checksum, size: info.Size(), pins: 1})
+	c.size += info.Size()
+	c.evict()
+
+	return c.path(checksum), nil
+}
+
+// Release unpins the content of checksum, which could be evicted afterwards.
+func (c *Cache) Release(checksum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[checksum]; ok {
+		elem.Value.(*cacheEntry).pins--
+	}
+	c.evict()
+}
+
+// must hold the lock
+func (c *Cache) evict() {
+	for elem := c.lru.Back(); elem != nil && c.size > c.limit; {
+		var entry = elem.Value.(*cacheEntry)
+		var prev = elem.Prev()
+		if entry.pins <= 0 {
+			if err := os.Remove(c.path(entry.checksum)); err != nil && !os.IsNotExist(err) {
+				log.WithError(err).Errorf("failed to evict %s from cache", entry.checksum)
+			}
+
+			c.lru.Remove(elem)
+			delete(c.entries, entry.checksum)
+			c.size -= entry.size
+		}
+		elem = prev
+	}
+}
@@ -2,83 +2,279 @@ package syncbox
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/yhsiang/syncbox/pkg/websocket"
 )
 
 var uploadPath = fmt.Sprintf("%s/upload", ServerUrl)
 var downloadPath = fmt.Sprintf("%s/download", ServerUrl)
+var sharesPath = fmt.Sprintf("%s/shares", ServerUrl)
+var statusPath = fmt.Sprintf("%s/status", ServerUrl)
+var linksPath = fmt.Sprintf("%s/links", ServerUrl)
 
 //go:generate callbackgen -type SyncClient
 type SyncClient struct {
 	client      *websocket.WebSocketClient
 	fileWatcher *FileWatcher
 	httpClient  *http.Client
+	header      http.Header
+	user        string
+	password    string
+	deviceID    string
+
+	// encoding is the one wanted, and active the one negotiated on the
+	// current connection
+	mu       sync.Mutex
+	encoding Encoding
+	active   Encoding
+	// compress is whether transfers are compressed, gzip whether the server
+	// of the current connection takes compressed uploads
+	compress bool
+	gzip     bool
+
+	// connected is set while connected, and ready once the server answered
+	// the hello of the connection
+	connected bool
+	ready     bool
+	// paused is set while syncing is paused, ctx is the one of Connect to
+	// connect again with on resume
+	paused bool
+	ctx    context.Context
+	// held are the changes of the server on paused folders, by folder
+	held map[string][]File
+	// journal keeps the local changes until the server has them, and
+	// inflight the ones sent by request id
+	journal  *Journal
+	inflight map[string][]File
+
+	// upload and download throttle the bodies of transfers
+	upload   *Limiter
+	download *Limiter
+
+	// messages are handled one at a time apart from the connection, which
+	// keeps reading while transfers run
+	messages  chan Message
+	transfers *Transfers
 
 	fileChangeCallbacks []func(files []File)
 }
 
 func NewSyncClient(url string, fileWatcher *FileWatcher) *SyncClient {
-	return &SyncClient{
-		client:      websocket.New(url, http.Header{}),
+	var header = http.Header{}
+	var s = &SyncClient{
+		client:      websocket.New(url, header),
 		fileWatcher: fileWatcher,
 		httpClient:  &http.Client{},
+		header:      header,
+		encoding:    EncodingMsgpack,
+		active:      EncodingJSON,
+		compress:    true,
+		inflight:    make(map[string][]File),
+		messages:    make(chan Message, 256),
+	}
+	s.transfers = NewTransfers(DefaultTransfers, s.transfer)
+	s.client.EnableCompression()
+
+	return s
+}
+
+// DefaultTransfers is the number of files transferred at once by default.
+const DefaultTransfers = 4
+
+// SetTransfers sets the number of files transferred at once, before
+// connecting.
+func (s *SyncClient) SetTransfers(workers int) {
+	s.transfers = NewTransfers(workers, s.transfer)
+}
+
+// SetJournal sets the outbound queue of local changes, which Connect needs.
+func (s *SyncClient) SetJournal(journal *Journal) {
+	s.journal = journal
+}
+
+// SetEncoding chooses the encoding of messages, json is easier to debug.
+func (s *SyncClient) SetEncoding(encoding Encoding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encoding = encoding
+}
+
+// SetCompression chooses whether the contents of transfers are compressed
+// with gzip when worth it and the server takes it, on by default.
+func (s *SyncClient) SetCompression(compress bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compress = compress
+}
+
+// SetLimits throttles uploads and downloads, before connecting.
+func (s *SyncClient) SetLimits(upload, download Schedule) {
+	s.upload = NewLimiter(upload)
+	s.download = NewLimiter(download)
+}
+
+func (s *SyncClient) write(msg Message) error {
+	s.mu.Lock()
+	encoding := s.active
+	s.mu.Unlock()
+
+	messageType, data, err := encoding.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.client.WriteMessage(messageType, data)
+}
+
+// SetBasicAuth sets the credentials used for the websocket and every http
+// request to the server.
+func (s *SyncClient) SetBasicAuth(user, password string) {
+	s.user = user
+	s.password = password
+
+	req := http.Request{Header: s.header}
+	req.SetBasicAuth(user, password)
+}
+
+func (s *SyncClient) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
 	}
+
+	return req, nil
 }
 
 func (s *SyncClient) Connect(ctx context.Context) {
+	deviceID, err := loadDeviceID(s.fileWatcher.path)
+	if err != nil {
+		log.WithError(err).Error("failed to load device id")
+	}
+	s.deviceID = deviceID
+
+	s.mu.Lock()
+	s.ctx = ctx
+	s.mu.Unlock()
+
 	s.client.SetReadTimeout(60 * time.Second)
 	s.client.OnConnect(func(c *websocket.WebSocketClient) {
 		fmt.Printf("connected to %s\n", s.client.Url)
+		var capabilities = []string{}
+		if s.fileWatcher.SymlinkPolicy() == SymlinkLink {
+			capabilities = append(capabilities, CapabilitySymlinks)
+		}
+		s.mu.Lock()
+		s.connected = true
+		s.ready = false
+		// requests of a lost connection are never acknowledged, the index
+		// sent after the hello replays their changes from the journal
+		s.inflight = make(map[string][]File)
+		s.mu.Unlock()
+
+		if err := s.hello(c, s.fileWatcher.Folders(), capabilities); err != nil {
+			log.WithError(err).Error("failed to send hello")
+		}
+	})
+
+	s.client.OnDisconnect(func(c *websocket.WebSocketClient) {
+		s.mu.Lock()
+		s.connected = false
+		s.ready = false
+		s.mu.Unlock()
 	})
 
 	s.client.OnMessage(func(m websocket.Message) {
-		log.Infof("receive message %s", m.Body)
 		var msg Message
-		err := json.Unmarshal(m.Body, &msg)
+		err := Unmarshal(m.Body, &msg)
 		if err != nil {
-			log.WithError(err).Error("failed to decode json")
+			log.WithError(err).Error("failed to decode message")
+			return
 		}
+		log.Infof("receive message %+v", msg)
 
-		switch msg.Command {
-		case "ack":
-			for _, file := range msg.Files {
-				switch file.Action {
-				case "upload":
-					err := s.uploadFile(file)
-					if err != nil {
-						log.WithError(err).Error("failed to upload")
-					}
-				case "download":
-					err := s.downloadFile(file)
-					if err != nil {
-						log.WithError(err).Error("failed to download")
-					}
-				}
+		s.messages <- msg
+	})
+
+	go s.dispatch(ctx)
+	s.transfers.Run(ctx)
 
+	s.OnFileChange(func(files []File) {
+		log.Infof("file changed %+v", files)
+		// what is transferred for these is outdated, the server asks again
+		for _, file := range files {
+			s.transfers.Cancel(file.FullName())
+			if file.From != "" {
+				s.transfers.Cancel(file.From)
 			}
 		}
+
+		if err := s.journal.Add(files); err != nil {
+			log.WithError(err).Error("failed to journal changes")
+		}
+
+		// changes in paused folders stay in the journal until resumed
+		var changes = []File{}
+		for _, file := range files {
+			if _, paused := s.fileWatcher.PausedFolder(file); !paused {
+				changes = append(changes, file)
+			}
+		}
+		if len(changes) == 0 {
+			return
+		}
+
+		if err := s.sync(changes); err != nil {
+			log.WithError(err).Error("failed to send message")
+		}
 	})
 
-	s.OnFileChange(func(files []File) {
-		log.Infof("file changed %+v", files)
-		var message = Message{
-			Command: "syn",
-			Files:   files,
+	// fetch what is selected now, the server leaves out the rest
+	s.fileWatcher.OnSelectionChange(func(selection *Selection) {
+		s.mu.Lock()
+		ready := s.ready
+		s.mu.Unlock()
+		if !ready {
+			return
 		}
 
-		if err := s.client.WriteJSON(message); err != nil {
-			log.WithError(err).Error("failed to send json")
+		if err := s.sendIndex(); err != nil {
+			log.WithError(err).Error("failed to send index")
+		}
+	})
+
+	// the reverted files are downloaded again by a full index
+	s.fileWatcher.OnRevert(func(files []File) {
+		s.mu.Lock()
+		ready := s.ready
+		s.mu.Unlock()
+		if !ready {
+			return
+		}
+
+		if err := s.sendIndex(); err != nil {
+			log.WithError(err).Error("failed to send index")
 		}
 	})
 
@@ -87,100 +283,922 @@ func (s *SyncClient) Connect(ctx context.Context) {
 	}
 }
 
+// dispatch handles the messages of the server in order, until ctx is done.
+func (s *SyncClient) dispatch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-s.messages:
+			s.handle(msg)
+		}
+	}
+}
+
+// handle applies a message of the server. Files are transferred by the
+// workers, directories, links, moves and deletes are quick and done here in
+// order.
+func (s *SyncClient) handle(msg Message) {
+	s.mu.Lock()
+	paused := s.paused
+	s.mu.Unlock()
+	if paused && msg.Command != CommandHello && msg.Command != CommandError {
+		// sync traffic is dropped, the index sent on resume catches up
+		return
+	}
+
+	switch msg.Command {
+	case CommandHello:
+		if msg.Hello == nil {
+			log.Error("server answered the hello without one")
+			return
+		}
+
+		log.Infof("server speaks protocol version %d, folders %v", msg.Hello.Version, msg.Hello.Folders)
+		s.negotiate(msg.Hello)
+		// checksums are only comparable computed alike, index with the
+		// algorithm of the server
+		if s.fileWatcher.SetHash(msg.Hello.HashOf()) {
+			if err := s.journal.Rehash(s.fileWatcher.Get); err != nil {
+				log.WithError(err).Error("failed to update journal")
+			}
+		}
+		s.mu.Lock()
+		s.ready = true
+		s.mu.Unlock()
+
+		// reconcile everything which changed while disconnected, once
+		// resumed if paused
+		if paused {
+			return
+		}
+		if err := s.sendIndex(); err != nil {
+			log.WithError(err).Error("failed to send index")
+		}
+
+	case CommandError:
+		if msg.Error == nil {
+			log.Errorf("request %s failed", msg.ReplyTo)
+			return
+		}
+
+		log.WithError(msg.Error).Errorf("request %s failed", msg.ReplyTo)
+		if msg.Error.Code == ErrorIndexInvalidated && !paused {
+			if err := s.sendIndex(); err != nil {
+				log.WithError(err).Error("failed to send index")
+			}
+		}
+
+	case CommandAck:
+		s.mu.Lock()
+		sent := s.inflight[msg.ReplyTo]
+		delete(s.inflight, msg.ReplyTo)
+		s.mu.Unlock()
+
+		var uploads = make(map[string]bool)
+		for _, file := range msg.Files {
+			if file.Action == ActionUpload {
+				uploads[file.FullName()] = true
+			}
+		}
+
+		// sent changes the server has a newer copy of, which replaces them
+		var changed = make(map[string]bool)
+		for _, file := range s.journal.Entries() {
+			changed[file.FullName()] = !file.Deleted && !file.Dir && file.Link == ""
+		}
+		var conflicts = make(map[string]bool)
+		for _, file := range sent {
+			conflicts[file.FullName()] = changed[file.FullName()]
+		}
+
+		// the server has every sent change it does not ask for
+		var movedDirs = make(map[string]bool)
+		for _, file := range sent {
+			if file.Dir && file.From != "" {
+				movedDirs[file.FullName()] = true
+			}
+			if _, paused := s.fileWatcher.PausedFolder(file); paused {
+				// told again by the index on resume
+				continue
+			}
+			if !uploads[file.FullName()] {
+				s.done(file)
+			}
+		}
+
+		// a directory could not be moved or synced as a whole, the
+		// entries under it are reconciled by the full index
+		var reconcile bool
+		for _, file := range msg.Files {
+			if s.hold(file) {
+				continue
+			}
+
+			var mode = s.fileWatcher.Mode(file)
+			switch file.Action {
+			case ActionUpload:
+				if !mode.Uploads() {
+					log.Infof("%s is not uploaded from a %s folder", file.FullName(), mode)
+					s.done(file)
+					continue
+				}
+
+				if !file.Dir && file.Link == "" {
+					s.transfers.Add(file)
+					continue
+				}
+
+				if err := s.transfer(context.Background(), file); err != nil {
+					log.WithError(err).Error("failed to upload")
+					continue
+				}
+				reconcile = reconcile || movedDirs[file.FullName()]
+			case ActionDownload, ActionRevert:
+				if conflicts[file.FullName()] && mode == ModeSendReceive {
+					if err := s.keepConflict(file); err != nil {
+						log.WithError(err).Errorf("failed to keep the local copy of %s", file.FullName())
+					}
+				}
+
+				if !file.Dir && file.Link == "" {
+					s.transfers.Add(file)
+					continue
+				}
+
+				if err := s.transfer(context.Background(), file); err != nil {
+					log.WithError(err).Error("failed to download")
+				}
+			case ActionMove:
+				if !mode.Downloads() {
+					continue
+				}
+
+				s.transfers.Cancel(file.From)
+				err := s.moveFile(file)
+				if err == errIndexNeeded {
+					reconcile = true
+					continue
+				}
+				if err != nil {
+					log.WithError(err).Error("failed to move")
+				}
+			case ActionDelete:
+				if !mode.Downloads() {
+					continue
+				}
+
+				s.transfers.Cancel(file.FullName())
+				err := s.deleteFile(file)
+				if err != nil {
+					log.WithError(err).Error("failed to delete")
+				}
+			case ActionReject:
+				log.Warnf("%s is in a read-only folder, local change is not uploaded", file.FullName())
+				s.done(file)
+			}
+
+		}
+
+		if msg.Cursor != nil {
+			s.fileWatcher.SetRemoteCursor(*msg.Cursor)
+		}
+
+		if reconcile {
+			if err := s.sendIndex(); err != nil {
+				log.WithError(err).Error("failed to send index")
+			}
+		}
+	}
+}
+
+// hello starts the handshake of a new connection, which is in json until the
+// server answers.
+func (s *SyncClient) hello(c *websocket.WebSocketClient, folders []string, capabilities []string) error {
+	s.mu.Lock()
+	s.active = EncodingJSON
+	s.gzip = false
+	if s.encoding == EncodingMsgpack {
+		capabilities = append(capabilities, CapabilityMsgpack)
+	}
+	if s.compress {
+		capabilities = append(capabilities, CapabilityGzip)
+	}
+	s.mu.Unlock()
+
+	for _, algorithm := range hashAlgorithms {
+		capabilities = append(capabilities, algorithm.Capability())
+	}
+
+	return c.WriteJSON(Message{
+		Command: CommandHello,
+		ID:      newRequestID(),
+		Hello: &Hello{
+			Version:      ProtocolVersion,
+			DeviceID:     s.deviceID,
+			Folders:      folders,
+			Capabilities: capabilities,
+		},
+	})
+}
+
+// negotiate switches to the encoding the server answered the hello with.
+func (s *SyncClient) negotiate(hello *Hello) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if hello.Has(CapabilityMsgpack) {
+		s.active = EncodingMsgpack
+	}
+	s.gzip = s.compress && hello.Has(CapabilityGzip)
+}
+
 func (s *SyncClient) Disconnect() {
 	s.client.Close()
 }
 
-func (s *SyncClient) uploadFile(file File) error {
-	var b bytes.Buffer
-	var fw io.Writer
-	w := multipart.NewWriter(&b)
-	fileData, err := os.Open(fmt.Sprintf("%s%s", s.fileWatcher.path, file.FullName()))
-	defer fileData.Close()
+// sync sends the local changes since the remote cursor, or the full index if
+// there is no cursor yet. Changes which could not be sent stay in the journal
+// until the next index.
+func (s *SyncClient) sync(changes []File) error {
+	s.mu.Lock()
+	ready := s.ready
+	s.mu.Unlock()
+	if !ready {
+		return nil
+	}
+
+	cursor := s.fileWatcher.RemoteCursor()
+	if cursor.IndexID == "" {
+		return s.sendIndex()
+	}
+
+	return s.send(Message{
+		Command: CommandSyn,
+		ID:      newRequestID(),
+		Since:   &cursor,
+		Files:   changes,
+	})
+}
+
+// sendIndex sends every local file, with the journal replayed in order at the
+// end, so that deletions made while disconnected are told as well.
+func (s *SyncClient) sendIndex() error {
+	// paused folders are left out altogether, their journaled changes wait
+	// until resumed and what the server answers for them is held
+	var pending = []File{}
+	var journaled = make(map[string]bool)
+	for _, file := range s.journal.Entries() {
+		journaled[file.FullName()] = true
+		if _, paused := s.fileWatcher.PausedFolder(file); !paused {
+			pending = append(pending, file)
+		}
+	}
+
+	var files = []File{}
+	for _, file := range s.fileWatcher.Files() {
+		if _, paused := s.fileWatcher.PausedFolder(file); !journaled[file.FullName()] && !paused {
+			files = append(files, file)
+		}
+	}
+
+	return s.send(Message{
+		Command:   CommandIndex,
+		ID:        newRequestID(),
+		Files:     append(files, pending...),
+		Selection: s.fileWatcher.Selection(),
+	})
+}
+
+// send writes a request carrying local changes, which are done once the
+// server acknowledged them.
+func (s *SyncClient) send(msg Message) error {
+	s.mu.Lock()
+	s.inflight[msg.ID] = msg.Files
+	s.mu.Unlock()
+
+	err := s.write(msg)
 	if err != nil {
-		return err
+		s.mu.Lock()
+		delete(s.inflight, msg.ID)
+		s.mu.Unlock()
 	}
 
-	if fw, err = w.CreateFormFile("file", file.Name); err != nil {
-		return err
+	return err
+}
+
+func (s *SyncClient) done(file File) {
+	if err := s.journal.Done(file); err != nil {
+		log.WithError(err).Error("failed to update journal")
+	}
+}
+
+// errIndexNeeded tells that the local copy could not follow a change on the
+// server, and the full index has to be reconciled.
+var errIndexNeeded = errors.New("local copy is out of sync")
+
+func newRequestID() string {
+	return uuid.New().String()
+}
+
+// loadDeviceID returns the id of this client, generated on first use and kept
+// in the state directory of root.
+func loadDeviceID(root string) (string, error) {
+	dir, err := ensureStateDir(root)
+	if err != nil {
+		return "", err
+	}
+
+	var path = dir + "/device_id"
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var id = uuid.New().String()
+	return id, ioutil.WriteFile(path, []byte(id+"\n"), 0644)
+}
+
+func (s *SyncClient) uploadFile(ctx context.Context, file File) error {
+	var formData = [][2]string{
+		{"path", file.Path},
+		{"filename", file.Name},
+	}
+
+	var fileData *os.File
+	if file.Link != "" {
+		target, err := os.Readlink(s.fileWatcher.path + file.FullName())
+		if err != nil {
+			return err
+		}
+
+		formData = append(formData, [2]string{"link", target})
+	} else if file.Dir {
+		info, err := os.Stat(s.fileWatcher.path + file.FullName())
+		if err != nil {
+			return err
+		}
+
+		formData = append(formData, [2]string{"dir", "true"})
+		formData = append(formData, [2]string{"mode", strconv.FormatUint(uint64(info.Mode().Perm()), 8)})
+	} else {
+		var err error
+		fileData, err = os.Open(fmt.Sprintf("%s%s", s.fileWatcher.path, file.FullName()))
+		if err != nil {
+			return err
+		}
+		defer fileData.Close()
+
+		info, err := fileData.Stat()
+		if err != nil {
+			return err
+		}
+
+		formData = append(formData, [2]string{"size", strconv.FormatInt(info.Size(), 10)})
+		formData = append(formData, [2]string{"mode", strconv.FormatUint(uint64(info.Mode().Perm()), 8)})
+		formData = append(formData, [2]string{"mtime", strconv.FormatInt(info.ModTime().UnixNano(), 10)})
+
+		if s.fileWatcher.Xattrs() {
+			attrs, sum, err := readXattrs(fileData.Name(), s.fileWatcher.Hash())
+			if err != nil {
+				return err
+			}
+
+			if sum != "" {
+				data, err := json.Marshal(attrs)
+				if err != nil {
+					return err
+				}
+				formData = append(formData, [2]string{"xattrs", string(data)})
+			}
+		}
+	}
+
+	var content io.Reader
+	if fileData != nil {
+		content = fileData
 	}
 
-	if _, err = io.Copy(fw, fileData); err != nil {
+	uploaded, err := s.post(ctx, formData, file.Name, content)
+	if err != nil {
 		return err
 	}
 
-	var formData = make(map[string]string)
-	formData["path"] = file.Path
-	formData["filename"] = file.Name
-	for key, value := range formData {
-		if fw, err = w.CreateFormField(key); err != nil {
-			log.WithError(err).Error("failed to create field")
-			continue
+	// the local copy is now the one of the server at that sequence
+	if local, ok := s.fileWatcher.Get(file.FullName()); ok && (local.Dir || local.Checksum == uploaded.Checksum) {
+		local.Seq = uploaded.Seq
+		s.fileWatcher.Set(local)
+	}
+
+	return nil
+}
+
+// post uploads a form of formData and the content of a file, if any, named
+// name.
+func (s *SyncClient) post(ctx context.Context, formData [][2]string, name string, content io.Reader) (UploadResponse, error) {
+	var uploaded UploadResponse
+	var b bytes.Buffer
+	var fw io.Writer
+	w := multipart.NewWriter(&b)
+
+	// fields go first so that the server could check them before the content
+	for _, field := range formData {
+		var err error
+		if fw, err = w.CreateFormField(field[0]); err != nil {
+			return uploaded, err
 		}
 
-		if _, err = io.Copy(fw, strings.NewReader(value)); err != nil {
-			log.WithError(err).Error("failed to add value")
-			continue
+		if _, err = io.Copy(fw, strings.NewReader(field[1])); err != nil {
+			return uploaded, err
+		}
+	}
+
+	s.mu.Lock()
+	var compress = s.gzip
+	s.mu.Unlock()
+
+	if content != nil {
+		if compress {
+			compress, content = peekCompressible(name, content)
+		}
+
+		var err error
+		if fw, err = w.CreateFormFile("file", name); err != nil {
+			return uploaded, err
+		}
+
+		if _, err = io.Copy(fw, content); err != nil {
+			return uploaded, err
 		}
 	}
 	w.Close()
 
-	req, err := http.NewRequest("POST", uploadPath, &b)
+	req, err := s.newRequest("POST", uploadPath, nil)
 	if err != nil {
-		return err
+		return uploaded, err
 	}
 
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", w.FormDataContentType())
+	// progress counts the content, limits what goes over the wire
+	var body io.Reader = countReader(ctx, &b)
+	if content != nil && compress {
+		var zr = gzipReader(body)
+		defer zr.Close()
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{limitReader(ctx, zr, s.upload), zr}
+		req.Header.Set("Content-Encoding", "gzip")
+	} else {
+		req.Body = ioutil.NopCloser(limitReader(ctx, body, s.upload))
+		req.ContentLength = int64(b.Len())
+	}
 
 	res, err := s.httpClient.Do(req)
 	if err != nil {
-		return err
+		return uploaded, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == StatusQuotaExceeded {
+		return uploaded, ErrQuotaExceeded
 	}
 
 	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("bad status: %s", res.Status)
+		return uploaded, fmt.Errorf("bad status: %s", res.Status)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&uploaded)
+	return uploaded, err
+}
+
+func (s *SyncClient) downloadFile(ctx context.Context, file File) error {
+	if !s.fileWatcher.Selection().Selected(file.FullName(), file.Dir) {
+		return nil
+	}
+
+	local, ok := s.fileWatcher.Get(file.FullName())
+	if ok && local.SameAs(file) {
+		local.Seq = file.Seq
+		s.fileWatcher.Set(local)
+		return nil
+	}
+
+	if file.Link != "" {
+		// the server is trusted no more than its clients are
+		if !linkWithin(file.FullName(), file.Link) {
+			log.Warnf("link %s to %s is not created, it points out of its folder", file.FullName(), file.Link)
+			return nil
+		}
+
+		// a scan between the change on disk and Set takes it for a local one,
+		// and removes it again in a mirror folder
+		s.fileWatcher.walkMu.Lock()
+		defer s.fileWatcher.walkMu.Unlock()
+
+		if err := createLink(s.fileWatcher.path+file.FullName(), file.Link); err != nil {
+			return err
+		}
+
+		file.RootPath = s.fileWatcher.path
+		s.fileWatcher.Set(file)
+		return nil
+	}
+
+	// only the mode or the extended attributes changed, or a directory
+	if ok && local.Link == "" && local.Dir == file.Dir && (file.Dir || local.Checksum == file.Checksum) {
+		s.fileWatcher.walkMu.Lock()
+		defer s.fileWatcher.walkMu.Unlock()
+
+		// attributes first, the mode could make the file read-only
+		if err := s.applyXattrs(file); err != nil {
+			return err
+		}
+
+		if err := applyMeta(s.fileWatcher.path+file.FullName(), file.Mode, 0); err != nil {
+			return err
+		}
+
+		local.Mode = file.Mode
+		local.Xattrs = file.Xattrs
+		local.XattrSum = file.XattrSum
+		local.Seq = file.Seq
+		s.fileWatcher.Set(local)
+		return nil
+	}
+
+	if file.Dir {
+		s.fileWatcher.walkMu.Lock()
+		defer s.fileWatcher.walkMu.Unlock()
+
+		if err := os.MkdirAll(s.fileWatcher.path+file.FullName(), 0755); err != nil {
+			return err
+		}
+
+		if err := applyMeta(s.fileWatcher.path+file.FullName(), file.Mode, 0); err != nil {
+			return err
+		}
+
+		file.RootPath = s.fileWatcher.path
+		s.fileWatcher.Set(file)
+		return nil
 	}
 
+	// downloaded aside first, throttled downloads take long enough for scans
+	// to see partial files
+	dir, err := ensureStateDir(s.fileWatcher.path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "download-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := s.fetch(ctx, file, tmp.Name()); err != nil {
+		return err
+	}
+
+	// what arrived is verified against the index of the server, a mismatch is
+	// a corrupt transfer or a file changed since, both worth another try
+	checksum, err := sumFile(tmp.Name(), s.fileWatcher.Hash())
+	if err != nil {
+		return err
+	}
+	if checksum != file.Checksum {
+		return errors.Errorf("checksum of %s is %s, expect %s", file.FullName(), checksum, file.Checksum)
+	}
+
+	s.fileWatcher.walkMu.Lock()
+	defer s.fileWatcher.walkMu.Unlock()
+
+	var filepath = fmt.Sprintf("%s%s", s.fileWatcher.path, file.FullName())
+	if err := os.MkdirAll(path.Dir(filepath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath); err != nil {
+		return err
+	}
+
+	if err := s.applyXattrs(file); err != nil {
+		return err
+	}
+
+	if err := applyMeta(filepath, file.Mode, file.ModTime); err != nil {
+		return err
+	}
+
+	file.RootPath = s.fileWatcher.path
+	s.fileWatcher.Set(file)
+	return nil
+}
+
+// transfer uploads or downloads file as the server asked, the errors
+// returned are worth another try.
+func (s *SyncClient) transfer(ctx context.Context, file File) error {
+	if file.Action != ActionUpload {
+		if !s.fileWatcher.Mode(file).Downloads() {
+			return s.keep(ctx, file)
+		}
+
+		return s.downloadFile(ctx, file)
+	}
+
+	err := s.uploadFile(ctx, file)
+	switch {
+	case os.IsNotExist(err):
+		// gone since, the deletion is a change of its own
+	case err == ErrQuotaExceeded:
+		log.Warnf("%s is not uploaded, quota exceeded", file.FullName())
+	case err != nil:
+		return err
+	}
+
+	s.done(file)
 	return nil
 }
 
-func (s *SyncClient) downloadFile(file File) error {
+// keep leaves the local copy of a file in a send-only folder as it is, and
+// uploads it over the server copy if they differ.
+func (s *SyncClient) keep(ctx context.Context, file File) error {
+	local, ok := s.fileWatcher.Get(file.FullName())
+	if !ok {
+		return nil
+	}
+
+	if local.SameAs(file) {
+		local.Seq = file.Seq
+		s.fileWatcher.Set(local)
+		return nil
+	}
+
+	return s.uploadFile(ctx, local)
+}
+
+// fetch downloads the content of file to fullPath.
+func (s *SyncClient) fetch(ctx context.Context, file File, fullPath string) error {
 	var url = fmt.Sprintf("%s/%s", downloadPath, file.ID)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := s.newRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
 
+	req = req.WithContext(ctx)
+	s.mu.Lock()
+	if s.compress {
+		req.Header.Set("Accept-Encoding", "gzip")
+	} else {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	s.mu.Unlock()
+
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	var fullPath = fmt.Sprintf("%s%s", s.fileWatcher.path, file.Path)
-	err = os.MkdirAll(fullPath, 0755)
-	if err != nil {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(path.Dir(fullPath), 0755); err != nil {
 		return err
 	}
 
-	var filepath = fmt.Sprintf("%s%s", s.fileWatcher.path, file.FullName())
-	f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE, 0666)
+	f, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	_, err = io.Copy(f, resp.Body)
-	if err != nil {
+	var body io.Reader = limitReader(ctx, resp.Body, s.download)
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	if _, err := io.Copy(f, countReader(ctx, body)); err != nil {
+		f.Close()
 		return err
 	}
 
+	return f.Close()
+}
+
+// applyXattrs sets the extended attributes of file on the local copy, if both
+// sides sync them.
+func (s *SyncClient) applyXattrs(file File) error {
+	if file.Dir || file.XattrSum == "" || !s.fileWatcher.Xattrs() {
+		return nil
+	}
+
+	return applyXattrs(s.fileWatcher.path+file.FullName(), file.Xattrs)
+}
+
+// moveFile renames the local copy of a file moved on the server, or downloads
+// it if the local copy is not the one moved.
+func (s *SyncClient) moveFile(file File) error {
+	if file.Dir {
+		return s.moveDir(file)
+	}
+
+	source, ok := s.fileWatcher.Get(file.From)
+	target, exists := s.fileWatcher.Get(file.FullName())
+	if !ok || source.Checksum != file.Checksum || exists && target.Checksum != file.Checksum {
+		// nothing to move, it is downloaded instead
+		file.Action = ActionDownload
+		file.From = ""
+		s.transfers.Add(file)
+		return nil
+	}
+
+	// no scan sees the source gone and the target not yet indexed
+	s.fileWatcher.walkMu.Lock()
+	defer s.fileWatcher.walkMu.Unlock()
+
+	if err := os.MkdirAll(s.fileWatcher.path+file.Path, 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(s.fileWatcher.path+file.From, s.fileWatcher.path+file.FullName()); err != nil {
+		return err
+	}
+
+	s.fileWatcher.Remove(file.From)
 	file.RootPath = s.fileWatcher.path
-	err = file.CalChecksum()
+	s.fileWatcher.Set(file)
+	return nil
+}
+
+// moveDir renames a local directory with everything under it. Local changes
+// under it move along and are synced from the new place.
+func (s *SyncClient) moveDir(file File) error {
+	_, hasSource := s.fileWatcher.Get(file.From)
+	target, hasTarget := s.fileWatcher.Get(file.FullName())
+	switch {
+	case hasTarget && target.Dir && !hasSource:
+		// moved here already, e.g. by this client
+		target.Seq = file.Seq
+		s.fileWatcher.Set(target)
+		return nil
+	case !hasSource || hasTarget:
+		return errIndexNeeded
+	}
+
+	s.fileWatcher.walkMu.Lock()
+	defer s.fileWatcher.walkMu.Unlock()
+
+	if err := os.MkdirAll(s.fileWatcher.path+file.Path, 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(s.fileWatcher.path+file.From, s.fileWatcher.path+file.FullName()); err != nil {
+		return err
+	}
+
+	s.fileWatcher.MoveTree(file.From, file.FullName(), file.Seq)
+	return nil
+}
+
+// deleteFile removes a file deleted on the server, unless it was changed
+// locally since. A directory is removed with everything under it, unless
+// anything under it was changed.
+func (s *SyncClient) deleteFile(file File) error {
+	local, ok := s.fileWatcher.Get(file.FullName())
+	if !ok {
+		return nil
+	}
+
+	if file.Dir && local.Dir && file.Checksum == "" {
+		// the server could not tell what it had, its entries were deleted on
+		// their own and what is left is kept
+		if err := os.Remove(s.fileWatcher.path + file.FullName()); err != nil {
+			log.Warnf("%s is kept, it was changed locally", file.FullName())
+			return nil
+		}
+
+		s.fileWatcher.RemoveTree(file.FullName())
+		return nil
+	}
+
+	if file.Dir && local.Dir {
+		if s.fileWatcher.TreeChecksum(file.FullName()) != file.Checksum {
+			log.Warnf("%s is kept, it was changed locally", file.FullName())
+			return nil
+		}
+
+		s.fileWatcher.RemoveTree(file.FullName())
+		return os.RemoveAll(s.fileWatcher.path + file.FullName())
+	}
+
+	if !local.sameContent(file) {
+		return nil
+	}
+
+	s.fileWatcher.Remove(file.FullName())
+	err := os.Remove(fmt.Sprintf("%s%s", s.fileWatcher.path, file.FullName()))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Grant gives user perm on a folder owned by the client's user.
+func (s *SyncClient) Grant(folder string, user string, perm Permission) error {
+	var form = url.Values{}
+	form.Set("folder", folder)
+	form.Set("user", user)
+	form.Set("permission", string(perm))
+
+	req, err := s.newRequest("POST", sharesPath, strings.NewReader(form.Encode()))
 	if err != nil {
 		return err
 	}
 
-	s.fileWatcher.Set(file)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("bad status: %s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
 	return nil
 }
+
+// Status fetches the storage usage of the client's user from the server.
+func (s *SyncClient) Status() (Status, error) {
+	var status Status
+	req, err := s.newRequest("GET", statusPath, nil)
+	if err != nil {
+		return status, err
+	}
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("bad status: %s", res.Status)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&status)
+	return status, err
+}
+
+// Share mints a public link to path on the server. An empty password, zero
+// expire or zero maxDownloads leaves the link without that restriction.
+func (s *SyncClient) Share(path string, password string, expire time.Duration, maxDownloads int) (LinkResponse, error) {
+	var link LinkResponse
+	var form = url.Values{}
+	form.Set("path", path)
+	form.Set("password", password)
+	if expire > 0 {
+		form.Set("expire", expire.String())
+	}
+	if maxDownloads > 0 {
+		form.Set("max_downloads", strconv.Itoa(maxDownloads))
+	}
+
+	req, err := s.newRequest("POST", linksPath, strings.NewReader(form.Encode()))
+	if err != nil {
+		return link, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return link, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return link, fmt.Errorf("bad status: %s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&link)
+	return link, err
+}
@@ -3,7 +3,12 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -13,6 +18,22 @@ import (
 
 var serverUrl = fmt.Sprintf("ws://%s/", ServerAddr)
 
+var user, password string
+var encoding string
+var symlinks string
+var xattrs bool
+
+var uploadLimit, downloadLimit string
+var compress bool
+var transfers int
+
+var cacheDir string
+var cacheSize int64
+
+var linkPassword string
+var linkExpire time.Duration
+var linkMaxDownloads int
+
 var (
 	clientCmd = &cobra.Command{
 		Use:   "syncbox",
@@ -28,9 +49,49 @@ var (
 			defer cancel()
 
 			fileWatcher := syncbox.NewFileWatcher(ctx, args[0])
+			enc, err := syncbox.ParseEncoding(encoding)
+			if err != nil {
+				return err
+			}
+
+			policy, err := syncbox.ParseSymlinkPolicy(symlinks)
+			if err != nil {
+				return err
+			}
+			fileWatcher.SetSymlinkPolicy(policy)
+			fileWatcher.SetXattrs(xattrs)
+			fileWatcher.EnableSelection()
+			fileWatcher.EnableModes()
+
+			journal, err := syncbox.NewJournal(args[0])
+			if err != nil {
+				return err
+			}
+
+			upload, download, err := parseLimits()
+			if err != nil {
+				return err
+			}
+
 			client := syncbox.NewSyncClient(serverUrl, fileWatcher)
+			client.SetBasicAuth(user, password)
+			client.SetEncoding(enc)
+			client.SetJournal(journal)
+			client.SetLimits(upload, download)
+			client.SetCompression(compress)
+			client.SetTransfers(transfers)
 			fileWatcher.OnChange(client.EmitFileChange)
 
+			// scan before connecting, so that the first index tells the
+			// server what changed while syncbox was not running
+			if err := fileWatcher.WalkDir(); err != nil {
+				return err
+			}
+
+			if err := client.ServeControl(ctx); err != nil {
+				return err
+			}
+
 			client.Connect(ctx)
 			defer client.Disconnect()
 
@@ -40,13 +101,487 @@ var (
 			return nil
 		},
 	}
+
+	grantCmd = &cobra.Command{
+		Use:   "grant [folder] [user] [none|ro|rw]",
+		Short: "grant a user access to a folder you own",
+		Args:  cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			perm, err := syncbox.ParsePermission(args[2])
+			if err != nil {
+				return err
+			}
+
+			client := syncbox.NewSyncClient(serverUrl, nil)
+			client.SetBasicAuth(user, password)
+			return client.Grant(args[0], args[1], perm)
+		},
+	}
+
+	statusCmd = &cobra.Command{
+		Use:   "status [directory path]",
+		Short: "show what the client running on a directory does, or the storage usage on the server",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 1 {
+				status, err := syncbox.NewControl(args[0]).Status()
+				if err != nil {
+					return err
+				}
+
+				printClientStatus(status)
+				return nil
+			}
+
+			client := syncbox.NewSyncClient(serverUrl, nil)
+			client.SetBasicAuth(user, password)
+			status, err := client.Status()
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("usage: %s\n", formatUsage(status.User))
+			for _, folder := range status.Folders {
+				fmt.Printf("  %s: %s\n", folder.Name, formatUsage(folder))
+			}
+
+			if bandwidth := status.Bandwidth; bandwidth != nil {
+				fmt.Printf("server upload: %s, %s per connection\n", formatRate(bandwidth.Upload), formatRate(bandwidth.ConnUpload))
+				fmt.Printf("server download: %s, %s per connection\n", formatRate(bandwidth.Download), formatRate(bandwidth.ConnDownload))
+			}
+
+			return nil
+		},
+	}
+
+	pendingCmd = &cobra.Command{
+		Use:   "pending [directory path]",
+		Short: "list the local changes not synced to the server yet",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			journal, err := syncbox.NewJournal(args[0])
+			if err != nil {
+				return err
+			}
+
+			for _, file := range journal.Entries() {
+				fmt.Printf("%-8s %s\n", file.Action, file.FullName())
+			}
+
+			return nil
+		},
+	}
+
+	mountCmd = &cobra.Command{
+		Use:   "mount [mountpoint]",
+		Short: "mount the server as a filesystem, files are downloaded when opened",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			enc, err := syncbox.ParseEncoding(encoding)
+			if err != nil {
+				return err
+			}
+
+			if cacheDir == "" {
+				dir, err := os.UserCacheDir()
+				if err != nil {
+					return err
+				}
+				cacheDir = filepath.Join(dir, "syncbox")
+			}
+
+			cache, err := syncbox.NewCache(cacheDir, cacheSize)
+			if err != nil {
+				return errors.Wrap(err, "failed to open cache")
+			}
+
+			upload, download, err := parseLimits()
+			if err != nil {
+				return err
+			}
+
+			client := syncbox.NewSyncClient(serverUrl, nil)
+			client.SetBasicAuth(user, password)
+			client.SetEncoding(enc)
+			client.SetLimits(upload, download)
+			client.SetCompression(compress)
+
+			mount := syncbox.NewMount(client, cache)
+			mount.Connect(ctx)
+			defer client.Disconnect()
+
+			go func() {
+				util.WaitSignals(ctx, syscall.SIGINT, syscall.SIGTERM)
+				cancel()
+			}()
+
+			return mount.Serve(ctx, args[0])
+		},
+	}
+
+	selectiveCmd = &cobra.Command{
+		Use:   "selective [directory path]",
+		Short: "list the server paths synced to the directory, everything without rules",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			selection, err := syncbox.LoadSelection(args[0])
+			if err != nil {
+				return err
+			}
+
+			if selection == nil {
+				return nil
+			}
+
+			for _, path := range selection.Include {
+				fmt.Printf("include %s\n", path)
+			}
+			for _, path := range selection.Exclude {
+				fmt.Printf("exclude %s\n", path)
+			}
+
+			return nil
+		},
+	}
+
+	selectiveAddCmd = &cobra.Command{
+		Use:   "add [path] [directory path]",
+		Short: "sync a server path to the directory, it is fetched by the running client",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// a running client fetches it right away
+			err := syncbox.NewControl(args[1]).AddFolder(args[0])
+			if err != syncbox.ErrNotRunning {
+				return err
+			}
+
+			selection, err := syncbox.LoadSelection(args[1])
+			if err != nil {
+				return err
+			}
+
+			if selection == nil {
+				selection = &syncbox.Selection{}
+			}
+
+			selection.Add(args[0])
+			return selection.Save(args[1])
+		},
+	}
+
+	selectiveRemoveCmd = &cobra.Command{
+		Use:   "remove [path] [directory path]",
+		Short: "stop syncing a server path, the running client evicts the local copies",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			err := syncbox.NewControl(args[1]).RemoveFolder(args[0])
+			if err != syncbox.ErrNotRunning {
+				return err
+			}
+
+			journal, err := syncbox.NewJournal(args[1])
+			if err != nil {
+				return err
+			}
+
+			if pending := journal.Under(args[0]); len(pending) > 0 {
+				return fmt.Errorf("%s has local changes not synced yet, see syncbox pending", pending[0].FullName())
+			}
+
+			selection, err := syncbox.LoadSelection(args[1])
+			if err != nil {
+				return err
+			}
+
+			if selection == nil {
+				selection = &syncbox.Selection{}
+			}
+
+			selection.Remove(args[0])
+			return selection.Save(args[1])
+		},
+	}
+
+	modeCmd = &cobra.Command{
+		Use:   "mode [directory path]",
+		Short: "list the folders of the directory which do not send and receive",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			modes, err := syncbox.LoadModes(args[0])
+			if err != nil {
+				return err
+			}
+
+			var folders []string
+			for folder := range modes {
+				folders = append(folders, folder)
+			}
+			sort.Strings(folders)
+
+			for _, folder := range folders {
+				fmt.Printf("%s %s\n", folder, modes[folder])
+			}
+
+			return nil
+		},
+	}
+
+	modeSetCmd = &cobra.Command{
+		Use:   "set [folder] [send-receive|send-only|receive-only|mirror] [directory path]",
+		Short: "change the direction a folder syncs in, the running client picks it up",
+		Args:  cobra.ExactArgs(3),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mode, err := syncbox.ParseFolderMode(args[1])
+			if err != nil {
+				return err
+			}
+
+			modes, err := syncbox.LoadModes(args[2])
+			if err != nil {
+				return err
+			}
+
+			modes.Set(strings.Trim(args[0], "/"), mode)
+			return modes.Save(args[2])
+		},
+	}
+
+	revertCmd = &cobra.Command{
+		Use:   "revert [directory path]",
+		Short: "undo the local changes in receive-only folders, on the next scan of the client",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return syncbox.RequestRevert(args[0])
+		},
+	}
+
+	pauseCmd = &cobra.Command{
+		Use:   "pause [directory path] [folder]",
+		Short: "pause syncing of the client running on a directory, or of one folder of it, local changes are kept for later",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 2 {
+				return syncbox.NewControl(args[0]).PauseFolder(args[1])
+			}
+
+			return syncbox.NewControl(args[0]).Pause()
+		},
+	}
+
+	resumeCmd = &cobra.Command{
+		Use:   "resume [directory path] [folder]",
+		Short: "resume syncing of the client running on a directory, or of one folder of it",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 2 {
+				return syncbox.NewControl(args[0]).ResumeFolder(args[1])
+			}
+
+			return syncbox.NewControl(args[0]).Resume()
+		},
+	}
+
+	rescanCmd = &cobra.Command{
+		Use:   "rescan [directory path]",
+		Short: "make the client running on a directory scan it now",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return syncbox.NewControl(args[0]).Rescan()
+		},
+	}
+
+	conflictsCmd = &cobra.Command{
+		Use:   "conflicts [directory path]",
+		Short: "list the copies kept of local changes which the server had newer ones of",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conflicts, err := syncbox.NewControl(args[0]).Conflicts()
+			if err != nil {
+				return err
+			}
+
+			for _, conflict := range conflicts {
+				fmt.Printf("%s\t%s\n", conflict.Name, conflict.Original)
+			}
+
+			return nil
+		},
+	}
+
+	shareCmd = &cobra.Command{
+		Use:   "share [path]",
+		Short: "print a public link to a file or folder on the server",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client := syncbox.NewSyncClient(serverUrl, nil)
+			client.SetBasicAuth(user, password)
+			link, err := client.Share(args[0], linkPassword, linkExpire, linkMaxDownloads)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(link.Url)
+			return nil
+		},
+	}
 )
 
+func formatUsage(usage syncbox.Usage) string {
+	if usage.Limit <= 0 {
+		return fmt.Sprintf("%s (unlimited)", formatBytes(usage.Used))
+	}
+
+	return fmt.Sprintf("%s of %s (%.1f%%)", formatBytes(usage.Used), formatBytes(usage.Limit), float64(usage.Used)*100/float64(usage.Limit))
+}
+
+func formatRate(rate int64) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+
+	return formatBytes(rate) + "/s"
+}
+
+func printClientStatus(status syncbox.ClientStatus) {
+	switch status.Connection {
+	case syncbox.ConnectionDisconnected:
+		fmt.Printf("disconnected from %s\n", status.Server)
+	case syncbox.ConnectionPaused:
+		fmt.Printf("paused, see syncbox resume\n")
+	default:
+		fmt.Printf("%s to %s\n", status.Connection, status.Server)
+	}
+	if status.Error != "" {
+		fmt.Printf("scan failed: %s\n", status.Error)
+	}
+
+	fmt.Println("folders:")
+	for _, folder := range status.Folders {
+		if folder.Error != "" {
+			fmt.Printf("  %s: %s, %s\n", folder.Name, folder.State, folder.Error)
+		} else if folder.Held > 0 {
+			fmt.Printf("  %s: %s, %d changes on the server held\n", folder.Name, folder.State, folder.Held)
+		} else {
+			fmt.Printf("  %s: %s\n", folder.Name, folder.State)
+		}
+	}
+
+	fmt.Printf("pending changes: %d\n", status.Pending)
+	if status.Conflicts > 0 {
+		fmt.Printf("conflicts: %d, see syncbox conflicts\n", status.Conflicts)
+	}
+	fmt.Printf("transfers: %d active, %d queued, %s\n", len(status.Active), len(status.Queued), formatProgress(status.Total))
+	for _, t := range status.Active {
+		fmt.Printf("  %s %s %s\n", t.Action, t.Name, formatProgress(t))
+	}
+	for _, t := range status.Queued {
+		if t.Error != "" {
+			fmt.Printf("  %s %s %s queued, attempt %d failed: %s\n", t.Action, t.Name, formatBytes(t.Size), t.Attempt, t.Error)
+		} else {
+			fmt.Printf("  %s %s %s queued\n", t.Action, t.Name, formatBytes(t.Size))
+		}
+	}
+	for _, t := range status.Failed {
+		fmt.Printf("  %s %s failed: %s\n", t.Action, t.Name, t.Error)
+	}
+
+	fmt.Printf("limits: upload %s, download %s\n", formatRate(status.Upload), formatRate(status.Download))
+}
+
+// formatProgress formats the bytes done of a transfer, its rate and how long
+// it takes still.
+func formatProgress(t syncbox.TransferStatus) string {
+	var s = fmt.Sprintf("%s of %s", formatBytes(t.Done), formatBytes(t.Size))
+	if t.Rate > 0 {
+		s += fmt.Sprintf(" at %s/s, %s left", formatBytes(t.Rate), time.Duration(t.ETA)*time.Second)
+	}
+
+	return s
+}
+
+// parseLimits parses the upload and download limits of the flags.
+func parseLimits() (syncbox.Schedule, syncbox.Schedule, error) {
+	upload, err := syncbox.ParseSchedule(uploadLimit)
+	if err != nil {
+		return upload, upload, err
+	}
+
+	download, err := syncbox.ParseSchedule(downloadLimit)
+	return upload, download, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 // Execute executes the root command.
 func ExecuteClientCmd() error {
-	clientCmd.SetUsageTemplate(`syncbox [directory path] e.g., synbox /tmp/dropbox/server`)
+	clientCmd.SetUsageTemplate(`syncbox [directory path] [--transfers n] [--upload-limit rate] [--download-limit rate] [--compress=false] e.g., synbox /tmp/dropbox/server
+syncbox grant [folder] [user] [none|ro|rw]
+syncbox status [directory path]
+syncbox share [path] [--link-password] [--expire 24h] [--max-downloads n]
+syncbox pending [directory path]
+syncbox selective [directory path]
+syncbox selective add|remove [path] [directory path]
+syncbox mode [directory path]
+syncbox mode set [folder] [send-receive|send-only|receive-only|mirror] [directory path]
+syncbox revert [directory path]
+syncbox pause|resume [directory path] [folder]
+syncbox rescan [directory path]
+syncbox conflicts [directory path]
+syncbox mount [mountpoint] [--cache-dir] [--cache-size bytes] [--upload-limit rate] [--download-limit rate] [--compress=false]
+`)
 	return clientCmd.Execute()
 }
 
 func init() {
+	clientCmd.PersistentFlags().StringVar(&user, "user", "", "user name to authenticate with")
+	clientCmd.PersistentFlags().StringVar(&password, "password", "", "password to authenticate with")
+	clientCmd.Flags().StringVar(&encoding, "encoding", "msgpack", "encoding of messages, json or msgpack")
+	clientCmd.Flags().StringVar(&symlinks, "symlinks", "link", "what to do with symbolic links, ignore, link or follow within the directory")
+	clientCmd.Flags().BoolVar(&xattrs, "xattrs", false, "sync user.* extended attributes, on linux")
+	clientCmd.Flags().IntVar(&transfers, "transfers", syncbox.DefaultTransfers, "number of files to transfer at once")
+	clientCmd.Flags().StringVar(&uploadLimit, "upload-limit", "", "bytes per second to upload at most, e.g. 1M or 1M,09:00-18:00=256K")
+	clientCmd.Flags().BoolVar(&compress, "compress", true, "compress file transfers with gzip when worth it")
+	clientCmd.Flags().StringVar(&downloadLimit, "download-limit", "", "bytes per second to download at most, e.g. 1M or 1M,09:00-18:00=256K")
+	clientCmd.AddCommand(grantCmd)
+	clientCmd.AddCommand(statusCmd)
+	clientCmd.AddCommand(pendingCmd)
+	clientCmd.AddCommand(selectiveCmd)
+	clientCmd.AddCommand(mountCmd)
+	selectiveCmd.AddCommand(selectiveAddCmd)
+	selectiveCmd.AddCommand(selectiveRemoveCmd)
+	clientCmd.AddCommand(modeCmd)
+	clientCmd.AddCommand(revertCmd)
+	clientCmd.AddCommand(pauseCmd)
+	clientCmd.AddCommand(resumeCmd)
+	clientCmd.AddCommand(rescanCmd)
+	clientCmd.AddCommand(conflictsCmd)
+	modeCmd.AddCommand(modeSetCmd)
+
+	mountCmd.Flags().StringVar(&encoding, "encoding", "msgpack", "encoding of messages, json or msgpack")
+	mountCmd.Flags().StringVar(&cacheDir, "cache-dir", "", "directory of downloaded contents, the user cache directory by default")
+	mountCmd.Flags().Int64Var(&cacheSize, "cache-size", 1<<30, "bytes of downloaded contents to keep")
+	mountCmd.Flags().StringVar(&uploadLimit, "upload-limit", "", "bytes per second to upload at most, e.g. 1M or 1M,09:00-18:00=256K")
+	mountCmd.Flags().StringVar(&downloadLimit, "download-limit", "", "bytes per second to download at most, e.g. 1M or 1M,09:00-18:00=256K")
+	mountCmd.Flags().BoolVar(&compress, "compress", true, "compress file transfers with gzip when worth it")
+
+	shareCmd.Flags().StringVar(&linkPassword, "link-password", "", "password required to open the link")
+	shareCmd.Flags().DurationVar(&linkExpire, "expire", 0, "duration after which the link expires")
+	shareCmd.Flags().IntVar(&linkMaxDownloads, "max-downloads", 0, "number of downloads after which the link expires")
+	clientCmd.AddCommand(shareCmd)
 }
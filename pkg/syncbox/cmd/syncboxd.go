@@ -3,6 +3,7 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -11,6 +12,16 @@ import (
 
 var ServerAddr = "localhost:3000"
 
+var usersFile string
+var quotasFile string
+var serverSymlinks string
+var serverXattrs bool
+var serverHash string
+var tombstoneRetention time.Duration
+
+var serverUploadLimit, serverDownloadLimit string
+var connUploadLimit, connDownloadLimit string
+
 var (
 	serverCmd = &cobra.Command{
 		Use:   "syncboxd",
@@ -25,12 +36,66 @@ var (
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
+			users, err := syncbox.LoadUsers(usersFile)
+			if err != nil {
+				return errors.Wrap(err, "failed to load users")
+			}
+
+			shares, err := syncbox.NewShareStore(args[0])
+			if err != nil {
+				return errors.Wrap(err, "failed to load shares")
+			}
+
+			quotas, err := syncbox.LoadQuotas(quotasFile)
+			if err != nil {
+				return errors.Wrap(err, "failed to load quotas")
+			}
+
+			links, err := syncbox.NewLinkStore(args[0])
+			if err != nil {
+				return errors.Wrap(err, "failed to load links")
+			}
+
+			versions, err := syncbox.NewVersionStore(args[0])
+			if err != nil {
+				return errors.Wrap(err, "failed to open versions")
+			}
+
+			policy, err := syncbox.ParseSymlinkPolicy(serverSymlinks)
+			if err != nil {
+				return err
+			}
+
+			algorithm, err := syncbox.ParseHashAlgorithm(serverHash)
+			if err != nil {
+				return err
+			}
+
 			fileWatcher := syncbox.NewFileWatcher(ctx, args[0])
-			server := syncbox.NewServer(ctx, ServerAddr, fileWatcher)
+			fileWatcher.SetSymlinkPolicy(policy)
+			fileWatcher.SetXattrs(serverXattrs)
+			fileWatcher.SetHash(algorithm)
+			fileWatcher.SetTombstoneRetention(tombstoneRetention)
+			var limits syncbox.Limits
+			if limits.Upload, err = syncbox.ParseSchedule(serverUploadLimit); err != nil {
+				return err
+			}
+			if limits.Download, err = syncbox.ParseSchedule(serverDownloadLimit); err != nil {
+				return err
+			}
+			if limits.ConnUpload, err = syncbox.ParseSchedule(connUploadLimit); err != nil {
+				return err
+			}
+			if limits.ConnDownload, err = syncbox.ParseSchedule(connDownloadLimit); err != nil {
+				return err
+			}
+
+			server := syncbox.NewServer(ctx, ServerAddr, fileWatcher, syncbox.NewAccess(users, shares, quotas), links, versions)
+			server.SetLimits(limits)
 
 			go fileWatcher.Run()
 
-			fmt.Printf("server listen on %s\n", ServerAddr)
+			fmt.Printf("server listen on %s, web interface on http://%s/web/\n", ServerAddr, ServerAddr)
 			return server.ListenAndServe()
 		},
 	}
@@ -43,4 +108,14 @@ func ExecuteServerCmd() error {
 }
 
 func init() {
+	serverCmd.Flags().StringVar(&usersFile, "users", "", "json file of user name to password, authentication is disabled without it")
+	serverCmd.Flags().StringVar(&quotasFile, "quotas", "", "json file of user and folder quotas in bytes")
+	serverCmd.Flags().BoolVar(&serverXattrs, "xattrs", false, "sync user.* extended attributes, on linux")
+	serverCmd.Flags().StringVar(&serverUploadLimit, "upload-limit", "", "bytes per second all clients upload at most, e.g. 10M or 10M,09:00-18:00=2M")
+	serverCmd.Flags().StringVar(&serverDownloadLimit, "download-limit", "", "bytes per second all clients download at most, e.g. 10M or 10M,09:00-18:00=2M")
+	serverCmd.Flags().StringVar(&connUploadLimit, "conn-upload-limit", "", "bytes per second each connection uploads at most")
+	serverCmd.Flags().StringVar(&connDownloadLimit, "conn-download-limit", "", "bytes per second each connection downloads at most")
+	serverCmd.Flags().StringVar(&serverSymlinks, "symlinks", "link", "what to do with symbolic links, ignore, link or follow within the directory")
+	serverCmd.Flags().DurationVar(&tombstoneRetention, "tombstone-retention", syncbox.DefaultTombstoneRetention, "how long deletions are kept for clients to catch up, 0 keeps them for good")
+	serverCmd.Flags().StringVar(&serverHash, "hash", string(syncbox.DefaultHash), "checksum algorithm of the index, sha256, blake3, xxhash or md5 for older clients")
 }
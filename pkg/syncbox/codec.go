@@ -0,0 +1,62 @@
+package syncbox
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Encoding of messages on the websocket. The hello messages are always json,
+// msgpack is used afterwards if both sides announce CapabilityMsgpack.
+type Encoding string
+
+const (
+	EncodingJSON    Encoding = "json"
+	EncodingMsgpack Encoding = "msgpack"
+)
+
+// CapabilityMsgpack is announced by a side able to read msgpack messages.
+const CapabilityMsgpack = "msgpack"
+
+func ParseEncoding(s string) (Encoding, error) {
+	switch e := Encoding(s); e {
+	case EncodingJSON, EncodingMsgpack:
+		return e, nil
+	}
+
+	return EncodingJSON, errors.Errorf("unknown encoding %q, expect json or msgpack", s)
+}
+
+// Marshal encodes v and returns it with the websocket message type to send it
+// as. msgpack reuses the json tags so both encodings share the same fields.
+func (e Encoding) Marshal(v interface{}) (int, []byte, error) {
+	if e != EncodingMsgpack {
+		data, err := json.Marshal(v)
+		return websocket.TextMessage, data, err
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return 0, nil, err
+	}
+
+	return websocket.BinaryMessage, buf.Bytes(), nil
+}
+
+// Unmarshal decodes a message of either encoding, json messages are always
+// objects while msgpack messages never start with '{'.
+func Unmarshal(data []byte, v interface{}) error {
+	if len(data) > 0 && data[0] == '{' {
+		return json.Unmarshal(data, v)
+	}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
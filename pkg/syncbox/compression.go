@@ -0,0 +1,120 @@
+package syncbox
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// CapabilityGzip is announced by a client which compresses the bodies of its
+// uploads, and answered by a server taking them. Downloads are compressed
+// when a request accepts gzip.
+const CapabilityGzip = "gzip"
+
+// minCompressSize is the size below which contents are sent as they are.
+const minCompressSize = 512
+
+// compressedExtensions are the file types compressed already.
+var compressedExtensions = map[string]bool{
+	".7z": true, ".apk": true, ".avi": true, ".br": true, ".bz2": true,
+	".docx": true, ".flac": true, ".gif": true, ".gz": true, ".heic": true,
+	".jar": true, ".jpeg": true, ".jpg": true, ".m4a": true, ".mkv": true,
+	".mov": true, ".mp3": true, ".mp4": true, ".ogg": true, ".pdf": true,
+	".png": true, ".pptx": true, ".rar": true, ".tgz": true, ".webm": true,
+	".webp": true, ".woff2": true, ".xlsx": true, ".xz": true, ".zip": true,
+	".zst": true,
+}
+
+// compressible tells whether a content named name, starting with head, is
+// worth compressing, by its extension and by its sniffed type.
+func compressible(name string, head []byte) bool {
+	if len(head) < minCompressSize || compressedExtensions[strings.ToLower(path.Ext(name))] {
+		return false
+	}
+
+	var contentType = http.DetectContentType(head)
+	for _, prefix := range []string{"image/", "video/", "audio/", "font/woff2", "application/zip", "application/x-gzip", "application/x-rar-compressed", "application/pdf"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// peekCompressible tells whether the content of r named name is worth
+// compressing, and returns a reader of the whole content.
+func peekCompressible(name string, r io.Reader) (bool, io.Reader) {
+	var br = bufio.NewReaderSize(r, minCompressSize)
+	head, _ := br.Peek(minCompressSize)
+	return compressible(name, head), br
+}
+
+// gzipReader compresses what is read from r as it is read.
+func gzipReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		var zw = gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// acceptsGzip tells whether a request takes a gzip response.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		var parts = strings.Split(strings.TrimSpace(encoding), ";")
+		if parts[0] == "gzip" && (len(parts) == 1 || strings.TrimSpace(parts[1]) != "q=0") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveGzip sends the content of f compressed if the request takes gzip and
+// it is worth it, and tells whether it did. Ranges are served as they are.
+func serveGzip(w http.ResponseWriter, r *http.Request, name string, modTime time.Time, f *os.File) bool {
+	if r.Header.Get("Range") != "" || !acceptsGzip(r) {
+		return false
+	}
+
+	var head = make([]byte, minCompressSize)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil || !compressible(name, head) {
+		return false
+	}
+
+	var contentType = mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(head)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return true
+	}
+
+	var zw = gzip.NewWriter(w)
+	if _, err := io.Copy(zw, f); err != nil {
+		return true
+	}
+	zw.Close()
+	return true
+}
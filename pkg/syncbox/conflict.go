@@ -0,0 +1,115 @@
+package syncbox
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// conflictMarker is in the name of the copy kept of a local change which the
+// server had a newer one of, e.g. report.sync-conflict-20060102-150405.txt.
+// The copy syncs like any other file.
+const conflictMarker = ".sync-conflict-"
+
+const conflictTimeLayout = "20060102-150405"
+
+// Conflict is a copy kept of a local change of Original.
+type Conflict struct {
+	Name     string `json:"name"`
+	Original string `json:"original"`
+	ModTime  int64  `json:"mtime"`
+}
+
+func conflictName(fullName string, t time.Time) string {
+	var dir, base = path.Split(fullName)
+	var ext = path.Ext(base)
+	if ext == base {
+		// a dot file
+		ext = ""
+	}
+
+	return dir + strings.TrimSuffix(base, ext) + conflictMarker + t.Format(conflictTimeLayout) + ext
+}
+
+// conflictOriginal returns the file a conflict copy was kept of.
+func conflictOriginal(fullName string) (string, bool) {
+	var dir, base = path.Split(fullName)
+	var i = strings.LastIndex(base, conflictMarker)
+	if i < 0 {
+		return "", false
+	}
+
+	var rest = base[i+len(conflictMarker):]
+	if len(rest) < len(conflictTimeLayout) {
+		return "", false
+	}
+
+	if _, err := time.Parse(conflictTimeLayout, rest[:len(conflictTimeLayout)]); err != nil {
+		return "", false
+	}
+
+	return dir + base[:i] + rest[len(conflictTimeLayout):], true
+}
+
+// Conflicts returns the conflict copies the watcher indexed, by name.
+func (f *FileWatcher) Conflicts() []Conflict {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var conflicts = []Conflict{}
+	for key, file := range f.files {
+		if file.Dir {
+			continue
+		}
+
+		if original, ok := conflictOriginal(key); ok {
+			conflicts = append(conflicts, Conflict{Name: key, Original: original, ModTime: file.ModTime})
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Name < conflicts[j].Name
+	})
+
+	return conflicts
+}
+
+// keepConflict copies the local change of file aside, before the newer copy
+// on the server is downloaded over it.
+func (s *SyncClient) keepConflict(file File) error {
+	var fullPath = s.fileWatcher.path + file.FullName()
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	var name = conflictName(file.FullName(), time.Now())
+	dst, err := os.OpenFile(s.fileWatcher.path+name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if err := copyFile(dst, fullPath); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	log.Warnf("%s changed here and on the server, the local copy is kept as %s", file.FullName(), name)
+	return nil
+}
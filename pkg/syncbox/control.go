@@ -0,0 +1,388 @@
+package syncbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// ErrNotRunning is returned by a Control when no client runs on the directory.
+var ErrNotRunning = errors.New("no client is running on the directory")
+
+const (
+	ConnectionConnected    = "connected"
+	ConnectionConnecting   = "connecting"
+	ConnectionDisconnected = "disconnected"
+	ConnectionPaused       = "paused"
+
+	FolderIdle     = "idle"
+	FolderScanning = "scanning"
+	FolderSyncing  = "syncing"
+	FolderError    = "error"
+	FolderPaused   = "paused"
+)
+
+// ClientStatus is what a running client is doing.
+type ClientStatus struct {
+	Server     string         `json:"server"`
+	Connection string         `json:"connection"`
+	Error      string         `json:"error,omitempty"`
+	Folders    []FolderStatus `json:"folders"`
+	// Pending are the local changes the server did not acknowledge yet
+	Pending   int `json:"pending"`
+	Conflicts int `json:"conflicts"`
+	// Total sums up the active and queued transfers
+	Total  TransferStatus   `json:"total"`
+	Active []TransferStatus `json:"active"`
+	Queued []TransferStatus `json:"queued"`
+	Failed []TransferStatus `json:"failed"`
+	// Upload and Download are the limits now in bytes per second, zero for
+	// unlimited
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// FolderStatus is the state of a top level folder, one of idle, scanning,
+// syncing, paused or error. Held are the changes of the server not applied
+// while paused.
+type FolderStatus struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+	Held  int    `json:"held,omitempty"`
+}
+
+func controlPath(root string) string {
+	return stateDirPath(root) + "/control.sock"
+}
+
+// ClientStatus reports the connection, the folders and the transfers of the
+// client.
+func (s *SyncClient) ClientStatus() ClientStatus {
+	s.mu.Lock()
+	var connection = ConnectionDisconnected
+	switch {
+	case s.paused:
+		connection = ConnectionPaused
+	case s.ready:
+		connection = ConnectionConnected
+	case s.connected:
+		connection = ConnectionConnecting
+	}
+	s.mu.Unlock()
+
+	var status = ClientStatus{
+		Server:     s.client.Url,
+		Connection: connection,
+		Upload:     s.upload.Rate(),
+		Download:   s.download.Rate(),
+	}
+	status.Active, status.Queued, status.Failed = s.transfers.Status()
+
+	var pending []File
+	if s.journal != nil {
+		pending = s.journal.Entries()
+	}
+	status.Pending = len(pending)
+	status.Conflicts = len(s.fileWatcher.Conflicts())
+
+	for _, list := range [][]TransferStatus{status.Active, status.Queued} {
+		for _, t := range list {
+			status.Total.Size += t.Size
+			status.Total.Done += t.Done
+			status.Total.Rate += t.Rate
+		}
+	}
+	if status.Total.Rate > 0 {
+		status.Total.ETA = (status.Total.Size - status.Total.Done + status.Total.Rate - 1) / status.Total.Rate
+	}
+
+	scanning, scanErr := s.fileWatcher.ScanState()
+	if scanErr != nil {
+		status.Error = scanErr.Error()
+	}
+
+	var syncing = make(map[string]bool)
+	var failed = make(map[string]string)
+	for _, list := range [][]TransferStatus{status.Active, status.Queued} {
+		for _, t := range list {
+			syncing[FolderOf(t.Name)] = true
+		}
+	}
+	for _, file := range pending {
+		syncing[FolderOf(file.FullName())] = true
+	}
+	for _, t := range status.Failed {
+		failed[FolderOf(t.Name)] = fmt.Sprintf("%s: %s", t.Name, t.Error)
+	}
+
+	var paused = make(map[string]bool)
+	for _, folder := range s.fileWatcher.PausedFolders() {
+		paused[folder] = true
+	}
+
+	status.Folders = []FolderStatus{}
+	for _, folder := range s.fileWatcher.Folders() {
+		var folderStatus = FolderStatus{Name: folder, State: FolderIdle}
+		switch {
+		case failed[folder] != "":
+			folderStatus.State = FolderError
+			folderStatus.Error = failed[folder]
+		case scanErr != nil:
+			folderStatus.State = FolderError
+			folderStatus.Error = scanErr.Error()
+		case paused[folder]:
+			folderStatus.State = FolderPaused
+			folderStatus.Held = s.heldCount(folder)
+		case scanning:
+			folderStatus.State = FolderScanning
+		case syncing[folder]:
+			folderStatus.State = FolderSyncing
+		}
+		status.Folders = append(status.Folders, folderStatus)
+	}
+
+	return status
+}
+
+// Pause stops syncing until Resume: the client disconnects and drops its
+// transfers, local changes are still journaled.
+func (s *SyncClient) Pause() {
+	s.mu.Lock()
+	if s.paused {
+		s.mu.Unlock()
+		return
+	}
+	s.paused = true
+	s.mu.Unlock()
+
+	s.client.Close()
+	s.transfers.Cancel("")
+	log.Info("sync paused")
+}
+
+// Resume connects again after Pause, the index sent on connecting catches up
+// with what changed meanwhile.
+func (s *SyncClient) Resume() {
+	s.mu.Lock()
+	if !s.paused {
+		s.mu.Unlock()
+		return
+	}
+	s.paused = false
+	ctx := s.ctx
+	s.mu.Unlock()
+
+	log.Info("sync resumed")
+	if err := s.client.Connect(ctx); err != nil {
+		log.WithError(err).Warn("failed to connect, retrying")
+	}
+}
+
+// AddFolder syncs the server path fullName to the directory, and fetches it
+// right away.
+func (s *SyncClient) AddFolder(fullName string) error {
+	var root = s.fileWatcher.path
+	selection, err := LoadSelection(root)
+	if err != nil {
+		return err
+	}
+
+	if selection == nil {
+		selection = &Selection{}
+	}
+
+	selection.Add(fullName)
+	if err := selection.Save(root); err != nil {
+		return err
+	}
+
+	return s.fileWatcher.WalkDir()
+}
+
+// RemoveFolder stops syncing the server path fullName and evicts the local
+// copies, unless there are local changes under it not synced yet.
+func (s *SyncClient) RemoveFolder(fullName string) error {
+	if pending := s.journal.Under(fullName); len(pending) > 0 {
+		return errors.Errorf("%s has local changes not synced yet, see syncbox pending", pending[0].FullName())
+	}
+
+	var root = s.fileWatcher.path
+	selection, err := LoadSelection(root)
+	if err != nil {
+		return err
+	}
+
+	if selection == nil {
+		selection = &Selection{}
+	}
+
+	selection.Remove(fullName)
+	if err := selection.Save(root); err != nil {
+		return err
+	}
+
+	return s.fileWatcher.WalkDir()
+}
+
+// ServeControl answers the local commands on a unix socket in the state
+// directory, until ctx is done. It fails if another client runs on the
+// directory.
+func (s *SyncClient) ServeControl(ctx context.Context) error {
+	var root = s.fileWatcher.path
+	if _, err := ensureStateDir(root); err != nil {
+		return err
+	}
+
+	var path = controlPath(root)
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.Errorf("another client is running on %s", root)
+	}
+	// left by a client which did not stop cleanly
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	var mux = http.NewServeMux()
+	mux.Handle("/status", &controlStatusHandler{context: ctx, client: s})
+	mux.Handle("/pause", &controlSyncHandler{context: ctx, client: s})
+	mux.Handle("/resume", &controlSyncHandler{context: ctx, client: s})
+	mux.Handle("/rescan", &controlSyncHandler{context: ctx, client: s})
+	mux.Handle("/conflicts", &controlConflictsHandler{context: ctx, client: s})
+	mux.Handle("/folders", &controlFoldersHandler{context: ctx, client: s})
+
+	var server = &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		os.Remove(path)
+	}()
+
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.WithError(err).Error("control socket failed")
+		}
+	}()
+
+	return nil
+}
+
+// Control talks to the client running on a directory.
+type Control struct {
+	root       string
+	httpClient *http.Client
+}
+
+func NewControl(root string) *Control {
+	var path = controlPath(root)
+	return &Control{
+		root: root,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// do sends a request to the client and decodes its answer into v.
+func (c *Control) do(method, path string, v interface{}) error {
+	if _, err := os.Stat(controlPath(c.root)); os.IsNotExist(err) {
+		return ErrNotRunning
+	}
+
+	req, err := http.NewRequest(method, "http://syncbox"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return ErrNotRunning
+		}
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("bad status: %s %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// Status fetches what the client is doing.
+func (c *Control) Status() (ClientStatus, error) {
+	var status ClientStatus
+	err := c.do("GET", "/status", &status)
+	return status, err
+}
+
+// Pause stops the client syncing until Resume.
+func (c *Control) Pause() error {
+	return c.do("POST", "/pause", nil)
+}
+
+// Resume makes the client sync again, catching up with what changed
+// meanwhile.
+func (c *Control) Resume() error {
+	return c.do("POST", "/resume", nil)
+}
+
+// PauseFolder makes the client hold syncing of a top level folder, while it
+// stays connected.
+func (c *Control) PauseFolder(folder string) error {
+	return c.do("POST", "/pause?folder="+url.QueryEscape(folder), nil)
+}
+
+// ResumeFolder makes the client sync a paused folder again.
+func (c *Control) ResumeFolder(folder string) error {
+	return c.do("POST", "/resume?folder="+url.QueryEscape(folder), nil)
+}
+
+// Rescan makes the client scan the directory now, and returns once it did.
+func (c *Control) Rescan() error {
+	return c.do("POST", "/rescan", nil)
+}
+
+// Conflicts fetches the conflict copies in the directory.
+func (c *Control) Conflicts() ([]Conflict, error) {
+	var conflicts []Conflict
+	err := c.do("GET", "/conflicts", &conflicts)
+	return conflicts, err
+}
+
+// AddFolder makes the client sync the server path fullName.
+func (c *Control) AddFolder(fullName string) error {
+	return c.do("POST", "/folders?path="+url.QueryEscape(fullName), nil)
+}
+
+// RemoveFolder makes the client stop syncing the server path fullName.
+func (c *Control) RemoveFolder(fullName string) error {
+	return c.do("DELETE", "/folders?path="+url.QueryEscape(fullName), nil)
+}
@@ -0,0 +1,111 @@
+package syncbox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// controlStatusHandler answers the status of the client on its control socket,
+// which only the owner of the directory reaches.
+type controlStatusHandler struct {
+	context context.Context
+	client  *SyncClient
+}
+
+func (h *controlStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.client.ClientStatus())
+}
+
+// controlSyncHandler pauses, resumes or rescans by its path, pausing and
+// resuming only the folder in the query if there is one.
+type controlSyncHandler struct {
+	context context.Context
+	client  *SyncClient
+}
+
+func (h *controlSyncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var folder = r.URL.Query().Get("folder")
+	var err error
+	switch {
+	case r.URL.Path == "/pause" && folder != "":
+		err = h.client.PauseFolder(folder)
+	case r.URL.Path == "/pause":
+		h.client.Pause()
+	case r.URL.Path == "/resume" && folder != "":
+		err = h.client.ResumeFolder(folder)
+	case r.URL.Path == "/resume":
+		h.client.Resume()
+	case r.URL.Path == "/rescan":
+		err = h.client.fileWatcher.WalkDir()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type controlConflictsHandler struct {
+	context context.Context
+	client  *SyncClient
+}
+
+func (h *controlConflictsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.client.fileWatcher.Conflicts())
+}
+
+// controlFoldersHandler adds the server path in the query to the selection
+// on POST, and removes it on DELETE.
+type controlFoldersHandler struct {
+	context context.Context
+	client  *SyncClient
+}
+
+func (h *controlFoldersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var fullName = r.URL.Query().Get("path")
+	if fullName == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		err = h.client.AddFolder(fullName)
+	case http.MethodDelete:
+		err = h.client.RemoveFolder(fullName)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
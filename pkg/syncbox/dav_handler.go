@@ -0,0 +1,259 @@
+package syncbox
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/webdav"
+)
+
+const davPrefix = "/dav"
+
+// davHandler exposes the server root as a WebDAV share under /dav/. Writes go
+// through the FileWatcher like uploads, so sync clients get them pushed.
+type davHandler struct {
+	context     context.Context
+	fileWatcher *FileWatcher
+	access      *Access
+	versions    *VersionStore
+	lockSystem  webdav.LockSystem
+}
+
+func newDavHandler(ctx context.Context, fileWatcher *FileWatcher, access *Access, versions *VersionStore) *davHandler {
+	return &davHandler{
+		context:     ctx,
+		fileWatcher: fileWatcher,
+		access:      access,
+		versions:    versions,
+		lockSystem:  webdav.NewMemLS(),
+	}
+}
+
+func (h *davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.access.Authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="syncbox"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if status, err := h.checkQuota(r, user); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var handler = &webdav.Handler{
+		Prefix: davPrefix,
+		FileSystem: &davFileSystem{
+			Dir:      webdav.Dir(h.fileWatcher.path),
+			access:   h.access,
+			versions: h.versions,
+			user:     user,
+		},
+		LockSystem: h.lockSystem,
+	}
+	handler.ServeHTTP(w, r)
+
+	switch r.Method {
+	case "PUT", "DELETE", "MKCOL", "MOVE", "COPY":
+		// let clients know right away instead of waiting for the next scan
+		if err := h.fileWatcher.WalkDir(); err != nil {
+			log.WithError(err).Error("failed to scan after webdav write")
+		}
+	}
+}
+
+// davName returns the full name of a path under davPrefix.
+func davName(urlPath string) string {
+	return path.Clean("/" + strings.TrimPrefix(urlPath, davPrefix))
+}
+
+// checkQuota checks the quotas of what a request writes, and returns the
+// status to answer if it would go over one. A PUT of unknown length is refused
+// where a quota applies, MOVE and COPY are charged the size of what they bring
+// into another folder.
+func (h *davHandler) checkQuota(r *http.Request, user string) (int, error) {
+	switch r.Method {
+	case "PUT":
+		var fullName = davName(r.URL.Path)
+		if r.ContentLength < 0 {
+			if h.access.QuotaLimited(user, fullName) {
+				return http.StatusLengthRequired, errors.New("the length is required where a quota applies")
+			}
+			return 0, nil
+		}
+
+		if err := h.access.CheckQuota(h.fileWatcher, user, fullName, r.ContentLength); err != nil {
+			return StatusQuotaExceeded, err
+		}
+
+	case "MOVE", "COPY":
+		destination, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			// answered by the webdav handler
+			return 0, nil
+		}
+
+		source, ok := h.fileWatcher.Get(davName(r.URL.Path))
+		if !ok {
+			return 0, nil
+		}
+
+		var target = File{Dir: source.Dir}
+		target.Path, target.Name = path.Split(davName(destination.Path))
+		if r.Method == "MOVE" && FolderOf(source.accessName()) == FolderOf(target.accessName()) {
+			return 0, nil
+		}
+
+		var size = source.Size
+		for _, file := range h.fileWatcher.List(source.FullName()) {
+			size += file.Size
+		}
+
+		if err := h.access.CheckQuota(h.fileWatcher, user, target.accessName(), size); err != nil {
+			return StatusQuotaExceeded, err
+		}
+	}
+
+	return 0, nil
+}
+
+// davFileSystem checks the permissions of one user on every operation, and
+// hides the state directory, links and folders the user could not read.
+type davFileSystem struct {
+	webdav.Dir
+	access   *Access
+	versions *VersionStore
+	user     string
+}
+
+func (fs *davFileSystem) check(name string, write bool) (string, error) {
+	var fullName = path.Clean("/" + name)
+	for _, part := range strings.Split(fullName, "/") {
+		if part == StateDir {
+			return "", os.ErrNotExist
+		}
+	}
+
+	perm := fs.access.Permission(fs.user, fullName+"/")
+	if !perm.CanRead() {
+		return "", os.ErrNotExist
+	}
+
+	// links could lead out of the root, they are neither listed nor followed
+	if fullName != "/" && (throughLink(string(fs.Dir), fullName) || isLink(string(fs.Dir)+fullName)) {
+		return "", os.ErrNotExist
+	}
+
+	if write && !perm.CanWrite() {
+		return "", os.ErrPermission
+	}
+
+	return fullName, nil
+}
+
+func (fs *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	fullName, err := fs.check(name, true)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.access.Claim(fs.user, fullName+"/"); err != nil {
+		return err
+	}
+
+	return fs.Dir.Mkdir(ctx, fullName, perm)
+}
+
+func (fs *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	var write = flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	fullName, err := fs.check(name, write)
+	if err != nil {
+		return nil, err
+	}
+
+	if write {
+		if err := fs.access.Claim(fs.user, fullName); err != nil {
+			return nil, err
+		}
+
+		if err := fs.versions.Archive(fullName); err != nil {
+			log.WithError(err).Error("failed to archive version")
+		}
+	}
+
+	file, err := fs.Dir.OpenFile(ctx, fullName, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &davFile{File: file, fs: fs, dir: fullName}, nil
+}
+
+func (fs *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	fullName, err := fs.check(name, true)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.versions.ArchiveTree(fullName); err != nil {
+		log.WithError(err).Error("failed to archive versions")
+	}
+
+	return fs.Dir.RemoveAll(ctx, fullName)
+}
+
+func (fs *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldFullName, err := fs.check(oldName, true)
+	if err != nil {
+		return err
+	}
+
+	newFullName, err := fs.check(newName, true)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.access.Claim(fs.user, newFullName); err != nil {
+		return err
+	}
+
+	return fs.Dir.Rename(ctx, oldFullName, newFullName)
+}
+
+func (fs *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fullName, err := fs.check(name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.Dir.Stat(ctx, fullName)
+}
+
+type davFile struct {
+	webdav.File
+	fs  *davFileSystem
+	dir string
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	if err != nil {
+		return infos, err
+	}
+
+	var visible []os.FileInfo
+	for _, info := range infos {
+		if _, err := f.fs.check(path.Join(f.dir, info.Name()), false); err == nil {
+			visible = append(visible, info)
+		}
+	}
+
+	return visible, nil
+}
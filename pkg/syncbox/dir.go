@@ -0,0 +1,165 @@
+package syncbox
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// parentOf returns the full name of the directory of fullName, or "" for
+// entries directly under the root.
+func parentOf(fullName string) string {
+	var dir, _ = path.Split(fullName)
+	return strings.TrimSuffix(dir, "/")
+}
+
+// under tells whether fullName is inside the directory dir.
+func under(fullName string, dir string) bool {
+	return strings.HasPrefix(fullName, dir+"/")
+}
+
+// ancestorIn returns the closest directory of fullName in dirs.
+func ancestorIn(fullName string, dirs map[string]File) (File, bool) {
+	for dir := parentOf(fullName); dir != ""; dir = parentOf(dir) {
+		if file, ok := dirs[dir]; ok {
+			return file, true
+		}
+	}
+
+	return File{}, false
+}
+
+// sumDirs sets the checksum of every directory in files to a hash of its
+// entries with algorithm, so that directories with the same tree have the
+// same checksum.
+func sumDirs(files map[string]File, algorithm HashAlgorithm) {
+	var children = make(map[string][]string)
+	for key := range files {
+		var parent = parentOf(key)
+		children[parent] = append(children[parent], key)
+	}
+
+	var sum func(dir string) string
+	sum = func(dir string) string {
+		var keys = children[dir]
+		sort.Strings(keys)
+
+		hash := algorithm.New()
+		for _, key := range keys {
+			var file = files[key]
+			if file.Dir {
+				file.Checksum = sum(key)
+				files[key] = file
+			}
+			fmt.Fprintf(hash, "%s %t %s\n", file.Name, file.Dir, file.Checksum)
+		}
+
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+
+	for key, file := range files {
+		if parent, ok := files[parentOf(key)]; file.Dir && !(ok && parent.Dir) {
+			file.Checksum = sum(key)
+			files[key] = file
+		}
+	}
+}
+
+// must hold the lock
+func (f *FileWatcher) subtree(dir string) FileSlice {
+	var files = FileSlice{}
+	for key, file := range f.files {
+		if key == dir || under(key, dir) {
+			files = append(files, file)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FullName() < files[j].FullName()
+	})
+
+	return files
+}
+
+// Tree returns the directory dir with everything under it.
+func (f *FileWatcher) Tree(dir string) FileSlice {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.subtree(dir)
+}
+
+// must hold the lock
+func (f *FileWatcher) treeChecksum(dir string) string {
+	var tree = make(map[string]File)
+	for _, file := range f.subtree(dir) {
+		tree[file.FullName()] = file
+	}
+
+	sumDirs(tree, f.hash)
+	return tree[dir].Checksum
+}
+
+// TreeChecksum returns the checksum of the directory dir as the index has it
+// now, which could be ahead of the last scan.
+func (f *FileWatcher) TreeChecksum(dir string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.treeChecksum(dir)
+}
+
+// MoveTree renames the directory from and everything under it in the index,
+// after it was renamed on disk.
+func (f *FileWatcher) MoveTree(from string, to string, seq int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, file := range f.subtree(from) {
+		delete(f.files, file.FullName())
+
+		var dir, name = path.Split(to + strings.TrimPrefix(file.FullName(), from))
+		file.Path = dir
+		file.Name = name
+		if file.FullName() == to {
+			file.Seq = seq
+		}
+		f.files[file.FullName()] = file
+	}
+
+	f.dirty = true
+}
+
+// RemoveTree removes the directory dir and everything under it from the
+// index, after it was removed on disk.
+func (f *FileWatcher) RemoveTree(dir string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, file := range f.subtree(dir) {
+		delete(f.files, file.FullName())
+	}
+
+	f.dirty = true
+}
+
+// accessName is the name permissions are checked on, directories end with a
+// slash so that a top level directory belongs to its own folder.
+func (f *File) accessName() string {
+	if f.Dir {
+		return f.FullName() + "/"
+	}
+
+	return f.FullName()
+}
+
+// fromAccessName is accessName of where a moved file was.
+func (f *File) fromAccessName() string {
+	if f.Dir {
+		return f.From + "/"
+	}
+
+	return f.From
+}
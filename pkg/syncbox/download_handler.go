@@ -1,37 +1,75 @@
 package syncbox
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"strconv"
-	"time"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 type downloadHandler struct {
 	context     context.Context
 	fileWatcher *FileWatcher
+	access      *Access
 }
 
 func (d *downloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	file := "test.pdf"
+	user, ok := d.access.Authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	downloadBytes, err := ioutil.ReadFile(file)
-	if err != nil {
-		fmt.Println(err)
+	var id = ID(strings.TrimPrefix(r.URL.Path, "/download/"))
+	file, ok := d.fileWatcher.Download(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !d.access.Permission(user, file.FullName()).CanRead() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	serveFile(w, r, d.fileWatcher.path, file)
+}
+
+// serveFile sends file under root as an attachment.
+func serveFile(w http.ResponseWriter, r *http.Request, root string, file File) {
+	// links synced as links have no content, and followed links are served
+	// only if they point within the root
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil || file.Link != "" {
+		http.NotFound(w, r)
+		return
 	}
 
-	mime := http.DetectContentType(downloadBytes)
+	resolved, err := filepath.EvalSymlinks(fmt.Sprintf("%s%s", root, file.FullName()))
+	if err != nil || !within(resolved, resolvedRoot) || within(resolved, resolvedRoot+"/"+StateDir) {
+		http.NotFound(w, r)
+		return
+	}
 
-	fileSize := len(string(downloadBytes))
+	f, err := os.Open(fmt.Sprintf("%s%s", root, file.FullName()))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
 
-	w.Header().Set("Content-Type", mime)
-	w.Header().Set("Content-Disposition", "attachment; filename="+file)
-	w.Header().Set("Content-Length", strconv.Itoa(fileSize))
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	http.ServeContent(w, r, file, time.Now(), bytes.NewReader(downloadBytes))
+	w.Header().Set("Content-Disposition", "attachment; filename="+file.Name)
+	if serveGzip(w, r, file.Name, info.ModTime(), f) {
+		return
+	}
 
-	return
+	http.ServeContent(w, r, file.Name, info.ModTime(), f)
 }
@@ -2,12 +2,11 @@ package syncbox
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -21,37 +20,146 @@ type ID string
 //go:generate callbackgen -type FileWatcher
 type FileWatcher struct {
 	mu              sync.Mutex
+	walkMu          sync.Mutex
 	path            string
 	ctx             context.Context
 	files           map[string]File
 	downloads       map[ID]File
 	changeCallbacks []func(files []File)
+
+	selectionChangeCallbacks []func(selection *Selection)
+	revertCallbacks          []func(files []File)
+
+	// deleted keeps a tombstone of every deleted file for retention since
+	// deletedAt, deletedHash is the algorithm of the ones whose checksum is
+	// of an earlier one, sequenced watchers number each change with seq, see
+	// index.go
+	deleted     map[string]File
+	deletedAt   map[string]int64
+	deletedHash map[string]HashAlgorithm
+	retention   time.Duration
+	// pruned is the latest sequence of the tombstones pruned, see Covers
+	pruned    int64
+	sequenced bool
+	indexID   string
+	seq       int64
+	remote    Cursor
+	dirty     bool
+
+	symlinks SymlinkPolicy
+	xattrs   bool
+	// skipped are the links warned about already, only touched by scans
+	skipped map[string]bool
+
+	// selection is what a client with selective sync indexes, reloaded when
+	// the saved one changes
+	selective        bool
+	selection        *Selection
+	selectionLoaded  bool
+	selectionModTime int64
+
+	// modes are the folders which do not send and receive, local are the
+	// changes held back in receive-only ones
+	modal        bool
+	modes        Modes
+	modesLoaded  bool
+	modesModTime int64
+	local        map[string]File
+
+	// paused are the top level folders whose changes are held, see pause.go
+	paused map[string]bool
+
+	// hash is the algorithm of the checksums, see hash.go
+	hash HashAlgorithm
+
+	// scanning is set while a scan runs, scanErr is the error of the last one
+	scanning bool
+	scanErr  error
 }
 
 type File struct {
-	Name     string    `json:"name"`
-	RootPath string    `json:"-"`
-	Path     string    `json:"path"`
-	Checksum string    `json:"checksum"`
-	State    string    `json:"-"`
-	Action   string    `json:"action"`
-	Content  io.Reader `json:"-"`
-	ID       ID        `json:"id"`
-}
-
-func (f *File) CalChecksum() error {
-	file, err := os.Open(fmt.Sprintf("%s%s", f.RootPath, f.FullName()))
+	Name     string `json:"name"`
+	RootPath string `json:"-"`
+	Path     string `json:"path"`
+	Checksum string `json:"checksum"`
+	// QuickSum is the xxHash of the content of regular files, which scans
+	// compare before computing the checksum again
+	QuickSum string `json:"quicksum,omitempty"`
+	Size     int64  `json:"size"`
+	Seq      int64  `json:"seq,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	// Dir is set for directories, whose checksum is one of their entries
+	Dir bool `json:"dir,omitempty"`
+	// Mode are the permission bits, ModTime the modification time in unix
+	// nanoseconds
+	Mode    os.FileMode `json:"mode,omitempty"`
+	ModTime int64       `json:"mtime,omitempty"`
+	// Xattrs are the user extended attributes and XattrSum their checksum,
+	// which is empty unless the watcher syncs them
+	Xattrs   map[string][]byte `json:"xattrs,omitempty"`
+	XattrSum string            `json:"xattrsum,omitempty"`
+	// Link is the target of a symbolic link
+	Link string `json:"link,omitempty"`
+	// From is the full name a moved file had before
+	From    string    `json:"from,omitempty"`
+	State   string    `json:"-"`
+	Action  Action    `json:"action,omitempty"`
+	Content io.Reader `json:"-"`
+	ID      ID        `json:"id"`
+}
+
+// CalChecksum computes the checksum of the content of the file on disk with
+// algorithm, and its quick checksum along.
+func (f *File) CalChecksum(algorithm HashAlgorithm) error {
+	sums, err := sumsOf(fmt.Sprintf("%s%s", f.RootPath, f.FullName()), algorithm, HashXXHash)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return err
+	f.Checksum = sums[0]
+	f.QuickSum = sums[1]
+	return nil
+}
+
+// sameContent tells whether other has the content of f. An empty checksum,
+// e.g. of a tombstone of an earlier algorithm, is compared by the quick
+// checksum.
+func (f *File) sameContent(other File) bool {
+	if f.Checksum != "" && other.Checksum != "" {
+		return f.Checksum == other.Checksum
+	}
+
+	return f.QuickSum != "" && f.QuickSum == other.QuickSum
+}
+
+// SameAs tells whether other has the same content, mode and extended
+// attributes. A mode of zero is unknown, e.g. in an index saved before modes
+// were synced, and so is an empty XattrSum.
+func (f *File) SameAs(other File) bool {
+	if f.Mode != 0 && other.Mode != 0 && f.Mode != other.Mode {
+		return false
 	}
 
-	f.Checksum = hex.EncodeToString(hash.Sum(nil))
+	if f.XattrSum != "" && other.XattrSum != "" && f.XattrSum != other.XattrSum {
+		return false
+	}
+
+	return f.Dir && other.Dir || f.Checksum == other.Checksum
+}
+
+// applyMeta sets the mode and the modification time, where known, on the
+// copy of a file at fullPath.
+func applyMeta(fullPath string, mode os.FileMode, modTime int64) error {
+	if mode != 0 {
+		if err := os.Chmod(fullPath, mode.Perm()); err != nil {
+			return err
+		}
+	}
+
+	if modTime != 0 {
+		var t = time.Unix(0, modTime)
+		return os.Chtimes(fullPath, t, t)
+	}
 
 	return nil
 }
@@ -62,81 +170,354 @@ func (f *File) FullName() string {
 
 type FileSlice []File
 
-func (files FileSlice) toMap() map[string]File {
-	var maps = make(map[string]File)
-	for _, file := range files {
-		maps[file.FullName()] = file
-	}
+func (f *FileWatcher) WalkDir() error {
+	// scans could be triggered besides the ticker, run one at a time so that a
+	// change is emitted only once
+	f.walkMu.Lock()
+	defer f.walkMu.Unlock()
+
+	err := f.scan()
 
-	return maps
+	f.mu.Lock()
+	f.scanning = false
+	f.scanErr = err
+	f.mu.Unlock()
+
+	return err
 }
 
-func (f *FileWatcher) WalkDir() error {
-	var changes []File
+// ScanState tells whether a scan is running, and the error of the last one.
+func (f *FileWatcher) ScanState() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.scanning, f.scanErr
+}
+
+// must hold the walk lock
+func (f *FileWatcher) scan() error {
+	f.mu.Lock()
+	f.scanning = true
+	f.mu.Unlock()
+
+	root, err := filepath.EvalSymlinks(f.path)
+	if err != nil {
+		return err
+	}
+
+	reselected, err := f.reloadSelection()
+	if err != nil {
+		return err
+	}
+
+	revert, err := f.reloadModes()
+	if err != nil {
+		return err
+	}
+
+	// what a failed walk left out is not deleted, the next scan tries again
 	var newFiles = make(map[string]File)
-	err := filepath.Walk(f.path, func(path string, info os.FileInfo, err error) error {
-		f.mu.Lock()
-		defer f.mu.Unlock()
+	if err := f.walk(newFiles, f.path, "", root, map[string]bool{root: true}); err != nil {
+		return err
+	}
+
+	reverted := f.holdBack(newFiles, revert)
+	sumDirs(newFiles, f.Hash())
+	changes := f.update(newFiles)
+	if len(changes) > 0 {
+		f.EmitChange(changes)
+	}
+
+	if reselected {
+		f.EmitSelectionChange(f.Selection())
+	}
+
+	if len(reverted) > 0 {
+		f.EmitRevert(reverted)
+	}
+
+	return nil
+}
 
+// walk indexes the tree at dir on disk as the directory fullName, "" for the
+// root. It stops at the first file or directory it cannot read, files removed
+// meanwhile are left out.
+func (f *FileWatcher) walk(newFiles map[string]File, dir string, fullName string, root string, visited map[string]bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		if err != nil {
 			log.WithError(err).Error("walk error")
+			return err
 		}
 
-		if !info.IsDir() {
-			var fileName = info.Name()
-			var pathFileName = strings.Replace(path, f.path, "", 1)
-			var pathOnly = strings.Replace(pathFileName, fileName, "", 1)
-			file := File{
-				Name:     fileName,
-				RootPath: f.path,
-				Path:     pathOnly,
-				ID:       ID(uuid.New().String()),
+		if path == dir {
+			return nil
+		}
+
+		if info.IsDir() && info.Name() == StateDir {
+			return filepath.SkipDir
+		}
+
+		var name = fullName + strings.TrimPrefix(path, dir)
+		if !f.Selection().Selected(name, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
+			return nil
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			return f.walkLink(newFiles, path, name, root, visited)
 
-			err2 := file.CalChecksum()
-			if err2 != nil {
-				return err2
+		case info.IsDir():
+			var parent, base = filepath.Split(name)
+			newFiles[name] = File{
+				Name:     base,
+				RootPath: f.path,
+				Path:     parent,
+				Dir:      true,
+				Mode:     info.Mode().Perm(),
+				ID:       ID(uuid.New().String()),
 			}
 
-			log.Debugf("%+v", file)
-			newFiles[file.FullName()] = file
+		case info.Mode().IsRegular():
+			return f.walkFile(newFiles, name, info)
 		}
 
 		return nil
 	})
+}
+
+func (f *FileWatcher) walkFile(newFiles map[string]File, fullName string, info os.FileInfo) error {
+	var parent, base = filepath.Split(fullName)
+	file := File{
+		Name:     base,
+		RootPath: f.path,
+		Path:     parent,
+		Size:     info.Size(),
+		Mode:     info.Mode().Perm(),
+		ModTime:  info.ModTime().UnixNano(),
+		ID:       ID(uuid.New().String()),
+	}
+
+	err := f.sum(&file)
+	if os.IsNotExist(err) {
+		// removed meanwhile
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if f.Xattrs() {
+		if file.Xattrs, file.XattrSum, err = readXattrs(f.path+fullName, f.Hash()); err != nil {
+			log.WithError(err).Errorf("failed to read extended attributes of %s", fullName)
+		}
+	}
 
+	log.Debugf("%+v", file)
+	newFiles[file.FullName()] = file
+	return nil
+}
+
+// sum computes the checksums of a file walked. Its checksum is only computed
+// again if the quick one changed, or the size or modification time did.
+func (f *FileWatcher) sum(file *File) error {
+	var algorithm = f.Hash()
+	indexed, ok := f.Get(file.FullName())
+	if !ok || indexed.Dir || indexed.Link != "" || indexed.QuickSum == "" || indexed.Size != file.Size || indexed.ModTime != file.ModTime {
+		return file.CalChecksum(algorithm)
+	}
+
+	quickSum, err := sumFile(file.RootPath+file.FullName(), HashXXHash)
+	if err != nil {
+		return err
+	}
+
+	if quickSum != indexed.QuickSum {
+		return file.CalChecksum(algorithm)
+	}
+
+	file.Checksum = indexed.Checksum
+	file.QuickSum = quickSum
+	return nil
+}
+
+// update replaces the index with newFiles and returns the changes. A file
+// removed and one created with the same content in a scan are a move. The
+// entries of a moved or deleted directory are not changes of their own.
+func (f *FileWatcher) update(newFiles map[string]File) []File {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	for _, oldFile := range f.files {
-		newFile, ok := newFiles[oldFile.FullName()]
+	var changes []File
+	var removed = make(map[string]File)
+	var candidates = make(map[string][]string)
+	for key, oldFile := range f.files {
+		newFile, ok := newFiles[key]
 		if !ok {
-			oldFile.State = "delete"
-			changes = append(changes, oldFile)
+			removed[key] = oldFile
+			candidates[moveKey(oldFile)] = append(candidates[moveKey(oldFile)], key)
+			continue
+		}
+
+		if !newFile.SameAs(oldFile) {
+			newFile.State = "update"
+			newFile.Seq = f.nextSeq(oldFile.Seq)
+			changes = append(changes, newFile)
+		} else {
+			// keep the id stable as long as the content is, the checksum
+			// of a directory changes with its entries only, and its mode
+			newFile.ID = oldFile.ID
+			newFile.Seq = oldFile.Seq
+			newFile.From = oldFile.From
 		}
+		newFiles[key] = newFile
+	}
+
+	for _, keys := range candidates {
+		sort.Strings(keys)
+	}
 
-		if ok && oldFile.Checksum != newFile.Checksum {
-			oldFile.State = "update"
-			changes = append(changes, oldFile)
+	var added []string
+	for key := range newFiles {
+		if _, ok := f.files[key]; !ok {
+			added = append(added, key)
 		}
 	}
+	// directories go before their entries
+	sort.Strings(added)
+
+	var moved = make(map[string]File)
+	for _, key := range added {
+		var newFile = newFiles[key]
+		delete(f.deleted, key)
+		delete(f.deletedAt, key)
+		delete(f.deletedHash, key)
+
+		if dir, ok := ancestorIn(key, moved); ok {
+			var from = dir.From + strings.TrimPrefix(key, dir.FullName())
+			if oldFile, ok := removed[from]; ok {
+				delete(removed, from)
+				newFile.ID = oldFile.ID
+				newFile.Seq = dir.Seq
+				newFile.From = from
+				f.tombstone(oldFile, dir.Seq)
+				if !f.sequenced {
+					newFile.From = ""
+				}
+				newFiles[key] = newFile
+				continue
+			}
+		}
 
-	for _, newFile := range newFiles {
-		if _, ok := f.files[newFile.FullName()]; !ok {
+		if from, ok := pair(newFile, removed, candidates); ok {
+			var oldFile = removed[from]
+			delete(removed, from)
+
+			newFile.State = "move"
+			newFile.From = from
+			newFile.ID = oldFile.ID
+			newFile.Seq = f.nextSeq(oldFile.Seq)
+			f.tombstone(oldFile, newFile.Seq)
+			changes = append(changes, newFile)
+			if newFile.Dir {
+				moved[key] = newFile
+			}
+
+			// only the server needs to remember the move, for clients
+			// catching up later
+			if !f.sequenced {
+				newFile.From = ""
+			}
+		} else {
 			newFile.State = "new"
+			newFile.Seq = f.nextSeq(0)
 			changes = append(changes, newFile)
 		}
+		newFiles[key] = newFile
+	}
+
+	var gone []string
+	for key := range removed {
+		gone = append(gone, key)
+	}
+	sort.Strings(gone)
+
+	var deletedDirs = make(map[string]File)
+	for _, key := range gone {
+		var oldFile = removed[key]
+		if dir, ok := ancestorIn(key, deletedDirs); ok {
+			f.tombstone(oldFile, dir.Seq)
+			continue
+		}
 
-		f.downloads[newFile.ID] = newFile
+		oldFile.State = "delete"
+		oldFile.Deleted = true
+		oldFile.Seq = f.nextSeq(oldFile.Seq)
+		f.tombstone(oldFile, oldFile.Seq)
+		changes = append(changes, oldFile)
+		if oldFile.Dir {
+			deletedDirs[key] = oldFile
+		}
 	}
 
 	f.files = newFiles
+	f.downloads = make(map[ID]File)
+	for _, file := range newFiles {
+		if !file.Dir && file.Link == "" {
+			f.downloads[file.ID] = file
+		}
+	}
 
-	if len(changes) > 0 {
-		f.EmitChange(changes)
+	f.pruneTombstones()
+	if len(changes) > 0 || f.dirty {
+		if err := f.save(); err != nil {
+			log.WithError(err).Error("failed to save index")
+		}
 	}
 
-	return err
+	return changes
+}
+
+// moveKey groups the files which could be moves of each other.
+func moveKey(file File) string {
+	if file.Dir {
+		return "dir:" + file.Checksum
+	}
+
+	return file.Checksum
+}
+
+// pair finds a removed file newFile could have been moved from.
+func pair(newFile File, removed map[string]File, candidates map[string][]string) (string, bool) {
+	var keys = candidates[moveKey(newFile)]
+	for i, key := range keys {
+		if _, ok := removed[key]; ok {
+			candidates[moveKey(newFile)] = keys[i+1:]
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+// must hold the lock
+func (f *FileWatcher) tombstone(file File, seq int64) {
+	if !f.sequenced {
+		return
+	}
+
+	file.State = "delete"
+	file.Deleted = true
+	file.Seq = seq
+	file.From = ""
+	f.deleted[file.FullName()] = file
+	f.deletedAt[file.FullName()] = time.Now().UnixNano()
+	delete(f.deletedHash, file.FullName())
 }
 
 func (f *FileWatcher) Run() {
@@ -160,43 +541,124 @@ func (f *FileWatcher) Run() {
 	}
 }
 
-func (f *FileWatcher) Compare(files FileSlice) FileSlice {
+func (f *FileWatcher) Get(fullName string) (File, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, ok := f.files[fullName]
+	return file, ok
+}
+
+func (f *FileWatcher) Download(id ID) (File, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, ok := f.downloads[id]
+	return file, ok
+}
+
+// List returns the files under dir, without directories, e.g. "/project", sorted by name.
+func (f *FileWatcher) List(dir string) FileSlice {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	var syncingFiles = FileSlice{} // avoid null
-	for _, file := range files {
-		if _, ok := f.files[file.FullName()]; !ok {
-			file.Action = "upload"
-			syncingFiles = append(syncingFiles, file)
+	var prefix = strings.TrimSuffix(dir, "/") + "/"
+	var files = FileSlice{}
+	for key, file := range f.files {
+		if strings.HasPrefix(key, prefix) && !file.Dir {
+			files = append(files, file)
 		}
 	}
 
-	var maps = files.toMap()
-	log.Infof("maps %+v", maps)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FullName() < files[j].FullName()
+	})
+
+	return files
+}
+
+// Usage returns the total size of the files in folder.
+func (f *FileWatcher) Usage(folder string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var used int64
 	for key, file := range f.files {
-		if _, ok := maps[key]; !ok {
-			log.Infof("file %+v", file)
-			file.Action = "download"
-			syncingFiles = append(syncingFiles, file)
+		if FolderOf(key) == folder {
+			used += file.Size
 		}
 	}
 
-	return syncingFiles
+	return used
+}
+
+// Folders returns the top level folders of the watched files.
+func (f *FileWatcher) Folders() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var seen = make(map[string]bool)
+	var folders = []string{}
+	for _, file := range f.files {
+		if folder := FolderOf(file.accessName()); folder != "" && !seen[folder] {
+			seen[folder] = true
+			folders = append(folders, folder)
+		}
+	}
+
+	sort.Strings(folders)
+	return folders
+}
+
+// Files returns every watched file.
+func (f *FileWatcher) Files() FileSlice {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var files = FileSlice{}
+	for _, file := range f.files {
+		files = append(files, file)
+	}
+
+	return files
 }
 
 func (f *FileWatcher) Set(file File) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
+	file.Action = ""
+	file.From = ""
 	f.files[file.FullName()] = file
+	f.dirty = true
+}
+
+func (f *FileWatcher) Remove(fullName string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.files, fullName)
+	f.dirty = true
 }
 
 func NewFileWatcher(ctx context.Context, path string) *FileWatcher {
-	return &FileWatcher{
-		path:      path,
-		ctx:       ctx,
-		files:     make(map[string]File),
-		downloads: make(map[ID]File),
+	var f = &FileWatcher{
+		path:        path,
+		ctx:         ctx,
+		files:       make(map[string]File),
+		downloads:   make(map[ID]File),
+		deleted:     make(map[string]File),
+		deletedAt:   make(map[string]int64),
+		deletedHash: make(map[string]HashAlgorithm),
+		retention:   DefaultTombstoneRetention,
+		symlinks:    SymlinkLink,
+		skipped:     make(map[string]bool),
+		hash:        DefaultHash,
 	}
+
+	if err := f.load(); err != nil {
+		log.WithError(err).Error("failed to load index")
+	}
+
+	return f
 }
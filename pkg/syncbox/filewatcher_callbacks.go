@@ -13,3 +13,23 @@ func (f *FileWatcher) EmitChange(files []File) {
 		cb(files)
 	}
 }
+
+func (f *FileWatcher) OnSelectionChange(cb func(selection *Selection)) {
+	f.selectionChangeCallbacks = append(f.selectionChangeCallbacks, cb)
+}
+
+func (f *FileWatcher) EmitSelectionChange(selection *Selection) {
+	for _, cb := range f.selectionChangeCallbacks {
+		cb(selection)
+	}
+}
+
+func (f *FileWatcher) OnRevert(cb func(files []File)) {
+	f.revertCallbacks = append(f.revertCallbacks, cb)
+}
+
+func (f *FileWatcher) EmitRevert(files []File) {
+	for _, cb := range f.revertCallbacks {
+		cb(files)
+	}
+}
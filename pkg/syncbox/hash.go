@@ -0,0 +1,245 @@
+package syncbox
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+	"lukechampine.com/blake3"
+)
+
+// HashAlgorithm is what the checksums of an index are computed with. The
+// server chooses it, and clients index with the one it answers the hello
+// with.
+type HashAlgorithm string
+
+const (
+	// HashMD5 is what indexes were computed with before the algorithm was
+	// recorded, and what peers which do not announce one use.
+	HashMD5 HashAlgorithm = "md5"
+	// HashSHA256 and HashBLAKE3 are strong enough to verify the integrity of
+	// what is transferred, BLAKE3 being the faster.
+	HashSHA256 HashAlgorithm = "sha256"
+	HashBLAKE3 HashAlgorithm = "blake3"
+	// HashXXHash is not cryptographic, it is the quickest to detect changes
+	// where integrity is left to the transport.
+	HashXXHash HashAlgorithm = "xxhash"
+)
+
+// DefaultHash is what new indexes of a server are computed with.
+const DefaultHash = HashSHA256
+
+// hashAlgorithms are the algorithms a client announces, by preference.
+var hashAlgorithms = []HashAlgorithm{HashBLAKE3, HashSHA256, HashXXHash, HashMD5}
+
+// capabilityHashPrefix announces an algorithm in the hello, e.g. hash:sha256.
+const capabilityHashPrefix = "hash:"
+
+func ParseHashAlgorithm(s string) (HashAlgorithm, error) {
+	switch h := HashAlgorithm(s); h {
+	case HashMD5, HashSHA256, HashBLAKE3, HashXXHash:
+		return h, nil
+	}
+
+	return HashMD5, errors.Errorf("unknown hash algorithm %q, expect one of md5, sha256, blake3, xxhash", s)
+}
+
+func (h HashAlgorithm) New() hash.Hash {
+	switch h {
+	case HashSHA256:
+		return sha256.New()
+	case HashBLAKE3:
+		return blake3.New(32, nil)
+	case HashXXHash:
+		return xxhash.New()
+	}
+
+	return md5.New()
+}
+
+// Sum returns the hex checksum of data.
+func (h HashAlgorithm) Sum(data []byte) string {
+	var hash = h.New()
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// sumFile returns the hex checksum of the content of the file at fullPath.
+func sumFile(fullPath string, algorithm HashAlgorithm) (string, error) {
+	sums, err := sumsOf(fullPath, algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	return sums[0], nil
+}
+
+// sumsOf returns the hex checksums of the content of the file at fullPath with
+// each of algorithms, reading it once.
+func sumsOf(fullPath string, algorithms ...HashAlgorithm) ([]string, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var hashes = make([]hash.Hash, len(algorithms))
+	var writers = make([]io.Writer, len(algorithms))
+	for i, algorithm := range algorithms {
+		hashes[i] = algorithm.New()
+		writers[i] = hashes[i]
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), file); err != nil {
+		return nil, err
+	}
+
+	var sums = make([]string, len(hashes))
+	for i, hash := range hashes {
+		sums[i] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	return sums, nil
+}
+
+// Capability announces the algorithm in the hello.
+func (h HashAlgorithm) Capability() string {
+	return capabilityHashPrefix + string(h)
+}
+
+// HashOf returns the algorithm the server answered the hello with, peers
+// which do not announce one use MD5.
+func (h *Hello) HashOf() HashAlgorithm {
+	for _, c := range h.Capabilities {
+		if strings.HasPrefix(c, capabilityHashPrefix) {
+			if algorithm, err := ParseHashAlgorithm(strings.TrimPrefix(c, capabilityHashPrefix)); err == nil {
+				return algorithm
+			}
+		}
+	}
+
+	return HashMD5
+}
+
+// HasHash tells whether a client announced it indexes with the algorithm.
+// Clients which announce none only know MD5.
+func (h *Hello) HasHash(algorithm HashAlgorithm) bool {
+	if h.Has(algorithm.Capability()) {
+		return true
+	}
+
+	for _, c := range h.Capabilities {
+		if strings.HasPrefix(c, capabilityHashPrefix) {
+			return false
+		}
+	}
+
+	return algorithm == HashMD5
+}
+
+// Hash returns the algorithm the checksums of the index are computed with.
+func (f *FileWatcher) Hash() HashAlgorithm {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.hash
+}
+
+// SetHash chooses the algorithm of the checksums, and tells whether it
+// changed. An index loaded with another one, MD5 for indexes saved before the
+// algorithm was recorded, is migrated in place, so that unchanged files are
+// not taken for changes.
+func (f *FileWatcher) SetHash(algorithm HashAlgorithm) bool {
+	// no scan sees half of the index migrated
+	f.walkMu.Lock()
+	defer f.walkMu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.hash == algorithm {
+		return false
+	}
+
+	if len(f.files) > 0 {
+		log.Infof("migrating the index from %s to %s checksums", f.hash, algorithm)
+	}
+
+	var from = f.hash
+	f.hash = algorithm
+	f.rehash(from)
+	f.dirty = true
+	return true
+}
+
+// rehash computes the checksums of the index again with the algorithm of the
+// watcher, from the one it had. Files changed on disk since they were indexed
+// keep their checksum, the next scan finds them changed anyway. The checksums
+// of extended attributes are computed from the ones indexed, so that none
+// of the former algorithm is kept.
+//
+// Tombstones have no content left to compute. Those of a file still indexed
+// elsewhere, e.g. where it was moved, take its checksum, the others keep the
+// one they had along with its algorithm, see sameAsTombstone.
+//
+// must hold the lock
+func (f *FileWatcher) rehash(from HashAlgorithm) {
+	var byQuickSum = make(map[string]File)
+	for key, file := range f.files {
+		if file.XattrSum != "" {
+			file.XattrSum = xattrChecksum(file.Xattrs, f.hash)
+		}
+
+		switch {
+		case file.Dir:
+			// summed from their entries below
+
+		case file.Link != "":
+			file.Checksum = linkChecksum(file.Link, f.hash)
+
+		default:
+			info, err := os.Lstat(f.path + key)
+			if err != nil || !info.Mode().IsRegular() || info.Size() != file.Size || file.ModTime != 0 && info.ModTime().UnixNano() != file.ModTime {
+				break
+			}
+
+			if err := file.CalChecksum(f.hash); err != nil {
+				log.WithError(err).Errorf("failed to migrate the checksum of %s", key)
+				break
+			}
+			byQuickSum[file.QuickSum] = file
+		}
+
+		f.files[key] = file
+		if !file.Dir && file.Link == "" {
+			f.downloads[file.ID] = file
+		}
+	}
+
+	sumDirs(f.files, f.hash)
+
+	for key, tombstone := range f.deleted {
+		if _, kept := f.deletedHash[key]; kept {
+			// of an earlier algorithm still
+			continue
+		}
+
+		switch live, ok := byQuickSum[tombstone.QuickSum]; {
+		case tombstone.Link != "":
+			tombstone.Checksum = linkChecksum(tombstone.Link, f.hash)
+		case !tombstone.Dir && tombstone.QuickSum != "" && ok && live.Size == tombstone.Size:
+			tombstone.Checksum = live.Checksum
+		default:
+			f.deletedHash[key] = from
+		}
+
+		f.deleted[key] = tombstone
+	}
+}
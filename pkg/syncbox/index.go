@@ -0,0 +1,505 @@
+package syncbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Cursor is a position in the index of a server. IndexID changes whenever the
+// sequence starts over, e.g. when the index of the server is lost.
+type Cursor struct {
+	IndexID string `json:"index_id"`
+	Seq     int64  `json:"seq"`
+}
+
+// indexState is what a FileWatcher persists under its state directory, so
+// that changes made while syncbox was not running are found on start.
+type indexState struct {
+	IndexID string `json:"index_id,omitempty"`
+	Seq     int64  `json:"seq,omitempty"`
+	Remote  Cursor `json:"remote"`
+	// Hash is the algorithm of the checksums, empty in indexes of MD5 ones
+	// saved before it was recorded
+	Hash    HashAlgorithm `json:"hash,omitempty"`
+	Files   []File        `json:"files"`
+	Deleted []File        `json:"deleted,omitempty"`
+	// DeletedAt is when each tombstone was made, in unix nanoseconds
+	DeletedAt map[string]int64 `json:"deleted_at,omitempty"`
+	// DeletedHash is the algorithm of tombstones kept from before Hash
+	DeletedHash map[string]HashAlgorithm `json:"deleted_hash,omitempty"`
+	// Pruned is the latest sequence of the tombstones pruned
+	Pruned int64 `json:"pruned,omitempty"`
+}
+
+// DefaultTombstoneRetention is how long a sequenced watcher keeps the
+// tombstones of deleted files.
+const DefaultTombstoneRetention = 30 * 24 * time.Hour
+
+// EnableSequence makes the watcher number every change with a monotonically
+// increasing sequence and keep tombstones of deleted files, as the server
+// does so that clients could ask for the changes since a sequence.
+func (f *FileWatcher) EnableSequence() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sequenced = true
+	if f.indexID == "" {
+		f.indexID = uuid.New().String()
+		f.dirty = true
+	}
+}
+
+// SetTombstoneRetention chooses how long tombstones are kept, zero keeps
+// them for good. A client which reconnects after a deletion was pruned uploads
+// its copy of the deleted file again.
+func (f *FileWatcher) SetTombstoneRetention(retention time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.retention = retention
+}
+
+// pruneTombstones drops the tombstones older than the retention, cursors up to
+// the latest of them are not covered anymore.
+//
+// must hold the lock
+func (f *FileWatcher) pruneTombstones() {
+	if f.retention <= 0 {
+		return
+	}
+
+	var oldest = time.Now().Add(-f.retention).UnixNano()
+	for key, file := range f.deleted {
+		if f.deletedAt[key] < oldest {
+			if file.Seq > f.pruned {
+				f.pruned = file.Seq
+			}
+
+			delete(f.deleted, key)
+			delete(f.deletedAt, key)
+			delete(f.deletedHash, key)
+			f.dirty = true
+		}
+	}
+}
+
+// must hold the lock
+func (f *FileWatcher) nextSeq(seq int64) int64 {
+	if !f.sequenced {
+		return seq
+	}
+
+	f.seq++
+	return f.seq
+}
+
+// Covers tells whether the index still has every change after since, which
+// is not the case for cursors of another index or older than the tombstones
+// pruned.
+func (f *FileWatcher) Covers(since Cursor) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return since.IndexID == f.indexID && since.Seq >= f.pruned
+}
+
+// Cursor returns the current position of the sequenced index.
+func (f *FileWatcher) Cursor() Cursor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return Cursor{IndexID: f.indexID, Seq: f.seq}
+}
+
+// RemoteCursor returns the position in the index of the server this client
+// has synced up to.
+func (f *FileWatcher) RemoteCursor() Cursor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.remote
+}
+
+// SetRemoteCursor moves the remote cursor forward, or resets it when the
+// server index changed.
+func (f *FileWatcher) SetRemoteCursor(cursor Cursor) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if cursor.IndexID != f.remote.IndexID || cursor.Seq > f.remote.Seq {
+		f.remote = cursor
+		f.dirty = true
+	}
+}
+
+// Resolution is what the server makes of the changes of a client: the
+// actions for the client, the files the client deleted and moved which should
+// be removed and moved on the server as well, and the cursor it is valid for.
+type Resolution struct {
+	Actions  FileSlice
+	Removals FileSlice
+	Moves    FileSlice
+	Cursor   Cursor
+}
+
+func (f *FileWatcher) newResolution() Resolution {
+	return Resolution{
+		Actions:  FileSlice{},
+		Removals: FileSlice{},
+		Moves:    FileSlice{},
+		Cursor:   Cursor{IndexID: f.indexID, Seq: f.seq},
+	}
+}
+
+// must hold the lock
+func (f *FileWatcher) checksumOf(file File) string {
+	if file.Dir {
+		return f.treeChecksum(file.FullName())
+	}
+
+	return file.Checksum
+}
+
+// restore asks the client to download a file again, with everything under it
+// if it is a directory.
+//
+// must hold the lock
+func (f *FileWatcher) restore(res *Resolution, file File) {
+	var files = FileSlice{file}
+	if file.Dir {
+		files = f.subtree(file.FullName())
+	}
+
+	for _, file := range files {
+		file.Action = ActionDownload
+		res.Actions = append(res.Actions, file)
+	}
+}
+
+// must hold the lock
+func (f *FileWatcher) resolveMove(res *Resolution, change File) bool {
+	source, live := f.files[change.From]
+	target, exists := f.files[change.FullName()]
+	switch {
+	case live && source.Dir != change.Dir:
+	case live && f.checksumOf(source) == change.Checksum && source.Seq <= change.Seq && (!exists || !target.Dir && target.Checksum == change.Checksum):
+		res.Moves = append(res.Moves, change)
+		return true
+	case live && source.Seq <= change.Seq && !source.Dir:
+		res.Removals = append(res.Removals, source)
+	case live:
+		// changed on the server after the client got it, restore it
+		f.restore(res, source)
+	}
+
+	return false
+}
+
+// resolveChange resolves one file of a client, which is new or changed since
+// the client last synced.
+//
+// must hold the lock
+func (f *FileWatcher) resolveChange(res *Resolution, change File) {
+	var key = change.FullName()
+	file, live := f.files[key]
+	switch {
+	case change.Dir && change.Deleted && live && file.Dir:
+		// the client removed the tree as the server has it, or the server
+		// changed something under it since
+		if f.treeChecksum(key) == change.Checksum {
+			res.Removals = append(res.Removals, file)
+		} else {
+			f.restore(res, file)
+		}
+	case change.Dir && !change.Deleted && live && file.Dir && file.SameAs(change):
+		// the entries of a directory sync on their own
+	case change.Deleted && live && file.Seq <= change.Seq:
+		res.Removals = append(res.Removals, file)
+	case change.Deleted && live:
+		// changed on the server after the client got it, restore it
+		f.restore(res, file)
+	case change.Deleted:
+	case live && file.SameAs(change):
+	case live && change.Seq < file.Seq:
+		file.Action = ActionDownload
+		res.Actions = append(res.Actions, file)
+	default:
+		change.Action = ActionUpload
+		change.From = ""
+		res.Actions = append(res.Actions, change)
+	}
+}
+
+// catchUp adds the changes on the server the client has not seen: live files
+// to download or move, and tombstones to delete. The entries of moved and
+// deleted directories come with their directory.
+//
+// must hold the lock
+func (f *FileWatcher) catchUp(res *Resolution, live FileSlice, tombstones map[string]File) {
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].FullName() < live[j].FullName()
+	})
+
+	var moved = make(map[string]File)
+	var movedDirs = make(map[string]File)
+	for _, file := range live {
+		if dir, ok := ancestorIn(file.FullName(), movedDirs); ok && dir.Seq == file.Seq {
+			continue
+		}
+
+		file.Action = ActionDownload
+		if _, ok := tombstones[file.From]; ok && f.movedFrom(file) {
+			file.Action = ActionMove
+			moved[file.From] = file
+			if file.Dir {
+				movedDirs[file.FullName()] = file
+			}
+		}
+		res.Actions = append(res.Actions, file)
+	}
+
+	var keys []string
+	for key := range tombstones {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// tombstones of an earlier algorithm go without a checksum, which clients
+	// could not compare, and directories among them after their entries, so
+	// that clients remove them once emptied
+	var emptied []File
+	var deletedDirs = make(map[string]File)
+	for _, key := range keys {
+		var tombstone = tombstones[key]
+		if dir, ok := ancestorIn(key, deletedDirs); ok && dir.Seq == tombstone.Seq {
+			continue
+		}
+
+		_, earlier := f.deletedHash[key]
+		if tombstone.Dir && !earlier {
+			deletedDirs[key] = tombstone
+		}
+
+		if _, ok := moved[key]; ok {
+			continue
+		}
+
+		tombstone.Action = ActionDelete
+		if earlier {
+			tombstone.Checksum = ""
+		}
+		if earlier && tombstone.Dir {
+			emptied = append(emptied, tombstone)
+			continue
+		}
+		res.Actions = append(res.Actions, tombstone)
+	}
+
+	for i := len(emptied) - 1; i >= 0; i-- {
+		res.Actions = append(res.Actions, emptied[i])
+	}
+}
+
+// Delta resolves the local changes of a client synced up to since.
+func (f *FileWatcher) Delta(since int64, changes FileSlice) Resolution {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var res = f.newResolution()
+	var reported = make(map[string]bool)
+	for _, change := range changes {
+		reported[change.FullName()] = true
+		if change.From != "" {
+			reported[change.From] = true
+			if f.resolveMove(&res, change) {
+				continue
+			}
+		}
+
+		f.resolveChange(&res, change)
+	}
+
+	var live = FileSlice{}
+	for key, file := range f.files {
+		if file.Seq > since && !reported[key] {
+			live = append(live, file)
+		}
+	}
+
+	var tombstones = make(map[string]File)
+	for key, file := range f.deleted {
+		if file.Seq > since && !reported[key] {
+			tombstones[key] = file
+		}
+	}
+
+	f.catchUp(&res, live, tombstones)
+	return res
+}
+
+// must hold the lock
+func (f *FileWatcher) movedFrom(file File) bool {
+	if file.From == "" {
+		return false
+	}
+
+	tombstone, ok := f.deleted[file.From]
+	return ok && tombstone.Seq == file.Seq
+}
+
+// Full resolves the complete index of a client, sent on every connect. Files
+// the client deleted while it was disconnected are in the index as deleted,
+// and the ones it moved carry where they were moved from.
+func (f *FileWatcher) Full(clientFiles FileSlice) Resolution {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var res = f.newResolution()
+	var reported = make(map[string]bool)
+	var stale = make(map[string]File)
+	for _, clientFile := range clientFiles {
+		var key = clientFile.FullName()
+		reported[key] = true
+
+		if clientFile.From != "" {
+			reported[clientFile.From] = true
+			if f.resolveMove(&res, clientFile) {
+				continue
+			}
+		}
+
+		_, live := f.files[key]
+		tombstone, deleted := f.deleted[key]
+		if !live && !clientFile.Deleted && deleted && clientFile.Seq > 0 && f.sameAsTombstone(key, clientFile) {
+			// the client still has what the server deleted or moved since
+			stale[key] = tombstone
+			continue
+		}
+
+		f.resolveChange(&res, clientFile)
+	}
+
+	var live = FileSlice{}
+	for key, file := range f.files {
+		if !reported[key] {
+			live = append(live, file)
+		}
+	}
+
+	f.catchUp(&res, live, stale)
+	return res
+}
+
+// sameAsTombstone tells whether file has what the tombstone of key had.
+// Tombstones of an earlier algorithm are compared by the quick checksum, and
+// directories among them by their entries alone, see catchUp.
+//
+// must hold the lock
+func (f *FileWatcher) sameAsTombstone(key string, file File) bool {
+	var tombstone = f.deleted[key]
+	if _, ok := f.deletedHash[key]; !ok {
+		return file.Checksum == tombstone.Checksum
+	}
+
+	if tombstone.Dir {
+		return file.Dir
+	}
+
+	return tombstone.QuickSum != "" && tombstone.QuickSum == file.QuickSum
+}
+
+func (f *FileWatcher) indexPath() string {
+	return stateDirPath(f.path) + "/index.json"
+}
+
+func (f *FileWatcher) load() error {
+	data, err := ioutil.ReadFile(f.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state indexState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	f.indexID = state.IndexID
+	f.seq = state.Seq
+	f.remote = state.Remote
+	f.pruned = state.Pruned
+	f.hash = HashMD5
+	if state.Hash != "" {
+		f.hash = state.Hash
+	}
+	for _, file := range state.Files {
+		file.RootPath = f.path
+		f.files[file.FullName()] = file
+		f.downloads[file.ID] = file
+	}
+
+	// tombstones saved before their time was kept are kept from now on
+	var now = time.Now().UnixNano()
+	for _, file := range state.Deleted {
+		f.deleted[file.FullName()] = file
+		f.deletedAt[file.FullName()] = now
+		if deletedAt, ok := state.DeletedAt[file.FullName()]; ok {
+			f.deletedAt[file.FullName()] = deletedAt
+		}
+		if algorithm, ok := state.DeletedHash[file.FullName()]; ok {
+			f.deletedHash[file.FullName()] = algorithm
+		}
+	}
+
+	return nil
+}
+
+// must hold the lock
+func (f *FileWatcher) save() error {
+	var state = indexState{
+		IndexID: f.indexID,
+		Seq:     f.seq,
+		Remote:  f.remote,
+		Hash:    f.hash,
+		Pruned:  f.pruned,
+		Files:   []File{},
+	}
+
+	for _, file := range f.files {
+		state.Files = append(state.Files, file)
+	}
+
+	if len(f.deleted) > 0 {
+		state.DeletedAt = f.deletedAt
+	}
+	if len(f.deletedHash) > 0 {
+		state.DeletedHash = f.deletedHash
+	}
+	for _, file := range f.deleted {
+		state.Deleted = append(state.Deleted, file)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ensureStateDir(f.path); err != nil {
+		return err
+	}
+
+	var tmp = f.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	f.dirty = false
+	return os.Rename(tmp, f.indexPath())
+}
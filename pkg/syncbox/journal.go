@@ -0,0 +1,280 @@
+package syncbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// journalSaveDelay is how long the journal waits to save after changes the
+// server took, so that an ack of many files writes it once.
+const journalSaveDelay = time.Second
+
+// Journal is the outbound queue of a client, the local changes which the
+// server has not taken yet. It is persisted under the state directory on
+// every change, so that changes made while the server is unreachable survive
+// a restart of the client. Changes the server took are saved shortly after,
+// one lost is only sent again.
+type Journal struct {
+	mu   sync.Mutex
+	root string
+	path string
+	// entries are the pending changes by full name, in the order of seq
+	entries map[string]journalEntry
+	seq     int64
+	saving  bool
+}
+
+type journalEntry struct {
+	file File
+	seq  int64
+}
+
+func NewJournal(root string) (*Journal, error) {
+	var j = &Journal{
+		root:    root,
+		path:    stateDirPath(root) + "/journal.json",
+		entries: make(map[string]journalEntry),
+	}
+
+	data, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []File
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		j.put(file)
+	}
+
+	return j, nil
+}
+
+// Add appends the changes in order. A change replaces the pending one of the
+// same path, so repeated edits are sent once with the latest content. A
+// pending move stays one, the server still has the source: an edit is sent as
+// the move with the new content, a delete as the delete of the source.
+func (j *Journal) Add(changes []File) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, change := range changes {
+		pending, replaced := j.entries[change.FullName()]
+		j.remove(change.FullName())
+		if change.Dir && (change.Deleted || change.From != "") {
+			j.moveTree(change)
+		}
+
+		if replaced && pending.file.Action == ActionMove && change.From == "" {
+			switch _, reused := j.entries[pending.file.From]; {
+			case !change.Deleted:
+				change.From = pending.file.From
+			case !reused:
+				change.Path, change.Name = path.Split(pending.file.From)
+			}
+		}
+
+		switch {
+		case change.Deleted:
+			change.Action = ActionDelete
+		case change.From != "":
+			change.Action = ActionMove
+			// the server never got the pending change of the source, so
+			// the move has to be uploaded
+			if j.remove(change.From) {
+				change.From = ""
+				change.Action = ActionUpload
+			}
+		default:
+			change.Action = ActionUpload
+		}
+		j.put(change)
+	}
+
+	return j.save()
+}
+
+// Done drops the entry of file once the server has it, unless the path
+// changed again since.
+func (j *Journal) Done(file File) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, ok := j.entries[file.FullName()]
+	if !ok || !entry.file.SameAs(file) || entry.file.Deleted != file.Deleted {
+		return nil
+	}
+
+	j.remove(file.FullName())
+	j.saveLater()
+	return nil
+}
+
+// Rehash takes the checksums of the pending changes from the index migrated
+// to another algorithm. Deletions keep theirs, the content is gone.
+func (j *Journal) Rehash(index func(fullName string) (File, bool)) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for key, entry := range j.entries {
+		if entry.file.Deleted {
+			continue
+		}
+
+		if file, ok := index(key); ok {
+			entry.file.Checksum = file.Checksum
+			j.entries[key] = entry
+		}
+	}
+
+	return j.save()
+}
+
+// moveTree follows a deleted or moved directory with the pending changes
+// under it, which the server does not have yet.
+//
+// must hold the lock
+func (j *Journal) moveTree(dir File) {
+	var from = dir.FullName()
+	if dir.From != "" {
+		from = dir.From
+	}
+
+	var moved []journalEntry
+	for key, entry := range j.entries {
+		if !under(key, from) {
+			continue
+		}
+
+		delete(j.entries, key)
+		if dir.Deleted {
+			continue
+		}
+
+		var parent, name = path.Split(dir.FullName() + strings.TrimPrefix(key, from))
+		entry.file.Path = parent
+		entry.file.Name = name
+		moved = append(moved, entry)
+	}
+
+	for _, entry := range moved {
+		j.entries[entry.file.FullName()] = entry
+	}
+}
+
+// Entries returns the pending changes, oldest first.
+func (j *Journal) Entries() []File {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.sorted()
+}
+
+// Under returns the pending changes of fullName and everything under it.
+func (j *Journal) Under(fullName string) []File {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	fullName = path.Clean("/" + fullName)
+	var entries = []File{}
+	for _, entry := range j.sorted() {
+		if covers(fullName, entry.FullName()) || entry.From != "" && covers(fullName, entry.From) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// must hold the lock
+func (j *Journal) sorted() []File {
+	var entries = make([]journalEntry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].seq < entries[b].seq
+	})
+
+	var files = make([]File, len(entries))
+	for i, entry := range entries {
+		files[i] = entry.file
+	}
+
+	return files
+}
+
+// must hold the lock
+func (j *Journal) put(file File) {
+	j.seq++
+	j.entries[file.FullName()] = journalEntry{file: file, seq: j.seq}
+}
+
+// must hold the lock
+func (j *Journal) remove(fullName string) bool {
+	if _, ok := j.entries[fullName]; !ok {
+		return false
+	}
+
+	delete(j.entries, fullName)
+	return true
+}
+
+// saveLater saves after journalSaveDelay, once for every change meanwhile.
+//
+// must hold the lock
+func (j *Journal) saveLater() {
+	if j.saving {
+		return
+	}
+
+	j.saving = true
+	time.AfterFunc(journalSaveDelay, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		if !j.saving {
+			// saved meanwhile with a change
+			return
+		}
+
+		if err := j.save(); err != nil {
+			log.WithError(err).Error("failed to save journal")
+		}
+	})
+}
+
+// must hold the lock
+func (j *Journal) save() error {
+	j.saving = false
+	data, err := json.MarshalIndent(j.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if _, err := ensureStateDir(j.root); err != nil {
+		return err
+	}
+
+	var tmp = j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, j.path)
+}
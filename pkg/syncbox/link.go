@@ -0,0 +1,176 @@
+package syncbox
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrLinkNotFound = errors.New("link not found")
+var ErrLinkExpired = errors.New("link expired")
+
+// Link is a public, unguessable url to a file or folder that could be used
+// without a syncbox client.
+type Link struct {
+	Token        string    `json:"token"`
+	Path         string    `json:"path"`
+	Owner        string    `json:"owner"`
+	Salt         string    `json:"salt,omitempty"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at,omitempty"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+}
+
+func (l *Link) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+func (l *Link) CheckPassword(password string) bool {
+	if !l.HasPassword() {
+		return true
+	}
+
+	var hash = hashPassword(l.Salt, password)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(l.PasswordHash)) == 1
+}
+
+func (l *Link) Expired(now time.Time) bool {
+	if !l.ExpiresAt.IsZero() && now.After(l.ExpiresAt) {
+		return true
+	}
+
+	return l.MaxDownloads > 0 && l.Downloads >= l.MaxDownloads
+}
+
+// LinkStore keeps the public links and persists them as json under the state
+// directory of the server root.
+type LinkStore struct {
+	mu    sync.Mutex
+	path  string
+	links map[string]*Link
+}
+
+func NewLinkStore(root string) (*LinkStore, error) {
+	dir, err := ensureStateDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var s = &LinkStore{
+		path:  dir + "/links.json",
+		links: make(map[string]*Link),
+	}
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.links); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Create mints a link to path. An empty password, zero ttl or zero
+// maxDownloads leaves the link without that restriction.
+func (s *LinkStore) Create(owner string, path string, password string, ttl time.Duration, maxDownloads int) (Link, error) {
+	token, err := randomHex(16)
+	if err != nil {
+		return Link{}, err
+	}
+
+	var link = &Link{
+		Token:        token,
+		Path:         path,
+		Owner:        owner,
+		MaxDownloads: maxDownloads,
+	}
+
+	if ttl > 0 {
+		link.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	if password != "" {
+		if link.Salt, err = randomHex(8); err != nil {
+			return Link{}, err
+		}
+		link.PasswordHash = hashPassword(link.Salt, password)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.links[token] = link
+	return *link, s.save()
+}
+
+func (s *LinkStore) Get(token string) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, ok := s.links[token]
+	if !ok {
+		return Link{}, ErrLinkNotFound
+	}
+
+	if link.Expired(time.Now()) {
+		return *link, ErrLinkExpired
+	}
+
+	return *link, nil
+}
+
+// CountDownload uses up one download of the link, and fails if none is left.
+func (s *LinkStore) CountDownload(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, ok := s.links[token]
+	if !ok {
+		return ErrLinkNotFound
+	}
+
+	if link.Expired(time.Now()) {
+		return ErrLinkExpired
+	}
+
+	link.Downloads++
+	return s.save()
+}
+
+func (s *LinkStore) save() error {
+	data, err := json.MarshalIndent(s.links, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.path, data, 0600)
+}
+
+func hashPassword(salt string, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	var b = make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,219 @@
+package syncbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type LinkResponse struct {
+	Url       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// linkHandler mints public links for users who could read the path.
+type linkHandler struct {
+	context     context.Context
+	fileWatcher *FileWatcher
+	access      *Access
+	links       *LinkStore
+}
+
+func (h *linkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	user, ok := h.access.Authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	fullName, ok := cleanName(r.FormValue("path"))
+	if !ok || throughLink(h.fileWatcher.path, fullName) || isLink(h.fileWatcher.path+fullName) {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(h.fileWatcher.path + fullName)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// directories belong to the folder they are, see accessName
+	var accessName = fullName
+	if info.IsDir() {
+		accessName += "/"
+	}
+
+	if !h.access.Permission(user, accessName).CanRead() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var ttl time.Duration
+	if expire := r.FormValue("expire"); expire != "" {
+		var err error
+		if ttl, err = time.ParseDuration(expire); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var maxDownloads int
+	if max := r.FormValue("max_downloads"); max != "" {
+		var err error
+		if maxDownloads, err = strconv.Atoi(max); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	link, err := h.links.Create(user, fullName, r.FormValue("password"), ttl, maxDownloads)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LinkResponse{
+		Url:       fmt.Sprintf("http://%s/s/%s", r.Host, link.Token),
+		ExpiresAt: link.ExpiresAt,
+	})
+}
+
+var linkListTemplate = template.Must(template.New("link").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Name}}</title></head>
+<body>
+<h1>{{.Name}}</h1>
+<ul>
+{{range .Files}}<li><a href="{{.Href}}">{{.Name}}</a> {{.Size}} bytes</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+type linkListEntry struct {
+	Name string
+	Href string
+	Size int64
+}
+
+// publicLinkHandler serves /s/<token> read-only to anyone holding the token.
+// A folder link lists its files, each served at /s/<token>/<relative path>.
+// Only what the owner of the link could still read is served.
+type publicLinkHandler struct {
+	context     context.Context
+	fileWatcher *FileWatcher
+	access      *Access
+	links       *LinkStore
+}
+
+func (h *publicLinkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var token, sub = strings.TrimPrefix(r.URL.Path, "/s/"), ""
+	if i := strings.Index(token, "/"); i >= 0 {
+		token, sub = token[:i], token[i:]
+	}
+
+	link, err := h.links.Get(token)
+	if err == ErrLinkExpired {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	_, password, _ := r.BasicAuth()
+	if !link.CheckPassword(password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="syncbox"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	info, err := os.Stat(h.fileWatcher.path + link.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var fullName = link.Path
+	if info.IsDir() {
+		if sub == "" || sub == "/" {
+			h.list(w, link)
+			return
+		}
+		fullName = strings.TrimSuffix(link.Path, "/") + path.Clean(sub)
+	} else if sub != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	// links are never followed, they could lead to folders of other users
+	file, ok := h.fileWatcher.Get(fullName)
+	if !ok || file.Dir || throughLink(h.fileWatcher.path, fullName) || isLink(h.fileWatcher.path+fullName) || !h.access.Permission(link.Owner, file.accessName()).CanRead() {
+		http.NotFound(w, r)
+		return
+	}
+
+	// probes and resumed downloads are not downloads of their own
+	if r.Method == "GET" && !resumes(r) {
+		if err := h.links.CountDownload(token); err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+	}
+
+	serveFile(w, r, h.fileWatcher.path, file)
+}
+
+// resumes tells whether a request asks for a range which does not start at
+// the beginning of the file.
+func resumes(r *http.Request) bool {
+	var ranges = r.Header.Get("Range")
+	if ranges == "" {
+		return false
+	}
+
+	return !strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(ranges, "bytes=")), "0-")
+}
+
+func (h *publicLinkHandler) list(w http.ResponseWriter, link Link) {
+	var dir = strings.TrimSuffix(link.Path, "/")
+	var entries []linkListEntry
+	for _, file := range h.fileWatcher.List(dir) {
+		if file.Link != "" || throughLink(h.fileWatcher.path, file.FullName()) || !h.access.Permission(link.Owner, file.accessName()).CanRead() {
+			continue
+		}
+
+		var rel = strings.TrimPrefix(file.FullName(), dir)
+		entries = append(entries, linkListEntry{
+			Name: strings.TrimPrefix(rel, "/"),
+			Href: "/s/" + link.Token + rel,
+			Size: file.Size,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	linkListTemplate.Execute(w, struct {
+		Name  string
+		Files []linkListEntry
+	}{path.Base(link.Path), entries})
+}
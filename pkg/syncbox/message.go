@@ -1,6 +1,114 @@
 package syncbox
 
+import (
+	"fmt"
+)
+
+// ProtocolVersion is bumped on every incompatible change of Message. The server
+// rejects clients speaking another version.
+const ProtocolVersion = 4
+
+type Command string
+
+const (
+	// CommandHello is the first message of a client, answered by the server
+	// with its own hello or an error.
+	CommandHello Command = "hello"
+	// CommandIndex sends the complete index of a client after every hello, or
+	// when its cursor into the server index is no longer valid, with the
+	// selection of a client which mirrors part of the server.
+	CommandIndex Command = "index"
+	// CommandSyn sends the changed files of a client since its cursor, and
+	// is answered with the changes on the server since.
+	CommandSyn Command = "syn"
+	// CommandAck tells a client what to do with files, either in reply to a
+	// syn or pushed on changes on the server.
+	CommandAck Command = "ack"
+	// CommandError reports a failed request.
+	CommandError Command = "error"
+)
+
+type Action string
+
+const (
+	ActionUpload   Action = "upload"
+	ActionDownload Action = "download"
+	ActionDelete   Action = "delete"
+	// ActionMove renames the file at From to the full name of the file,
+	// instead of transferring it again.
+	ActionMove Action = "move"
+	// ActionRevert replaces a local edit in a read-only folder with the server
+	// copy.
+	ActionRevert Action = "revert"
+	// ActionReject refuses a new file in a read-only folder.
+	ActionReject Action = "reject"
+)
+
+// CapabilityPush is announced by a server pushing its own changes to clients.
+const CapabilityPush = "push"
+
 type Message struct {
-	Command string `json:"cmd"`
-	Files   []File `json:"files"`
+	Command Command `json:"cmd"`
+	// ID identifies a request, and ReplyTo the request a response answers.
+	ID      string `json:"id,omitempty"`
+	ReplyTo string `json:"reply_to,omitempty"`
+	Hello   *Hello `json:"hello,omitempty"`
+	// Since is the cursor of a syn, Cursor the one an ack brings a client to.
+	Since  *Cursor        `json:"since,omitempty"`
+	Cursor *Cursor        `json:"cursor,omitempty"`
+	Error  *ProtocolError `json:"error,omitempty"`
+	Files  []File         `json:"files,omitempty"`
+	// Selection comes with an index, the client mirrors everything without
+	Selection *Selection `json:"selection,omitempty"`
+}
+
+type Hello struct {
+	Version      int      `json:"version"`
+	DeviceID     string   `json:"device_id,omitempty"`
+	Folders      []string `json:"folders"`
+	Capabilities []string `json:"capabilities"`
+}
+
+func (h *Hello) Has(capability string) bool {
+	for _, c := range h.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ErrorCode string
+
+const (
+	ErrorIncompatibleVersion ErrorCode = "incompatible_version"
+	ErrorHelloRequired       ErrorCode = "hello_required"
+	ErrorBadMessage          ErrorCode = "bad_message"
+	ErrorUnknownCommand      ErrorCode = "unknown_command"
+	// ErrorUnsupportedHash is answered to a client which does not index with
+	// the hash algorithm of the server.
+	ErrorUnsupportedHash ErrorCode = "unsupported_hash"
+	// ErrorIndexInvalidated asks the client for a full index.
+	ErrorIndexInvalidated ErrorCode = "index_invalidated"
+)
+
+type ProtocolError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func NewErrorMessage(replyTo string, code ErrorCode, format string, args ...interface{}) Message {
+	return Message{
+		Command: CommandError,
+		ReplyTo: replyTo,
+		Error: &ProtocolError{
+			Code:    code,
+			Message: fmt.Sprintf(format, args...),
+		},
+	}
 }
@@ -0,0 +1,283 @@
+package syncbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// FolderMode is the direction a folder of a client syncs in.
+type FolderMode string
+
+const (
+	// ModeSendReceive syncs both ways, the default.
+	ModeSendReceive FolderMode = "send-receive"
+	// ModeSendOnly uploads local changes and never downloads or deletes
+	// anything locally, e.g. for backups.
+	ModeSendOnly FolderMode = "send-only"
+	// ModeReceiveOnly downloads the changes on the server, local changes are
+	// kept out of the index until they are reverted.
+	ModeReceiveOnly FolderMode = "receive-only"
+	// ModeMirror is receive-only with local changes reverted on every scan.
+	ModeMirror FolderMode = "mirror"
+)
+
+func ParseFolderMode(s string) (FolderMode, error) {
+	switch m := FolderMode(s); m {
+	case ModeSendReceive, ModeSendOnly, ModeReceiveOnly, ModeMirror:
+		return m, nil
+	}
+
+	return ModeSendReceive, errors.Errorf("unknown folder mode %q, expect one of send-receive, send-only, receive-only, mirror", s)
+}
+
+// Uploads tells whether local changes are sent to the server.
+func (m FolderMode) Uploads() bool {
+	return m != ModeReceiveOnly && m != ModeMirror
+}
+
+// Downloads tells whether changes on the server are applied locally.
+func (m FolderMode) Downloads() bool {
+	return m != ModeSendOnly
+}
+
+// Modes are the folders of a client which do not send and receive, by their
+// name as FolderOf returns it.
+type Modes map[string]FolderMode
+
+func modesPath(root string) string {
+	return stateDirPath(root) + "/modes.json"
+}
+
+func revertPath(root string) string {
+	return stateDirPath(root) + "/revert"
+}
+
+// LoadModes reads the folder modes of the client at root.
+func LoadModes(root string) (Modes, error) {
+	var modes = Modes{}
+	data, err := ioutil.ReadFile(modesPath(root))
+	if os.IsNotExist(err) {
+		return modes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &modes); err != nil {
+		return nil, err
+	}
+
+	return modes, nil
+}
+
+// Save writes the folder modes of the client at root, which a running client
+// picks up on its next scan.
+func (m Modes) Save(root string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if _, err := ensureStateDir(root); err != nil {
+		return err
+	}
+
+	var tmp = modesPath(root) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, modesPath(root))
+}
+
+// Of returns the mode of the folder a file is in.
+func (m Modes) Of(file File) FolderMode {
+	if mode, ok := m[FolderOf(file.accessName())]; ok {
+		return mode
+	}
+
+	return ModeSendReceive
+}
+
+// Set changes the mode of folder.
+func (m Modes) Set(folder string, mode FolderMode) {
+	if mode == ModeSendReceive {
+		delete(m, folder)
+		return
+	}
+
+	m[folder] = mode
+}
+
+// RequestRevert asks the client at root to revert the local changes in its
+// receive-only folders, on its next scan.
+func RequestRevert(root string) error {
+	if _, err := ensureStateDir(root); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(revertPath(root), nil, 0644)
+}
+
+// EnableModes makes the watcher follow the folder modes saved under the state
+// directory.
+func (f *FileWatcher) EnableModes() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.modal = true
+}
+
+// Mode returns the mode of the folder file is in.
+func (f *FileWatcher) Mode(file File) FolderMode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.modes.Of(file)
+}
+
+// reloadModes reads the folder modes again if they were saved since, and
+// tells whether a revert was requested.
+func (f *FileWatcher) reloadModes() (bool, error) {
+	if !f.modal {
+		return false, nil
+	}
+
+	var revert bool
+	if err := os.Remove(revertPath(f.path)); err == nil {
+		revert = true
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	var modTime int64
+	if info, err := os.Stat(modesPath(f.path)); err == nil {
+		modTime = info.ModTime().UnixNano()
+	}
+
+	f.mu.Lock()
+	var loaded = f.modesLoaded && modTime == f.modesModTime
+	f.mu.Unlock()
+	if loaded {
+		return revert, nil
+	}
+
+	modes, err := LoadModes(f.path)
+	if err != nil {
+		return revert, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.modes = modes
+	f.modesModTime = modTime
+	f.modesLoaded = true
+	return revert, nil
+}
+
+// holdBack keeps the local changes in receive-only and mirror folders out of
+// newFiles, so that the index still has what the server has and they are
+// never emitted. Changes in mirror folders, and on revert in receive-only
+// ones too, are undone: new files are removed, and changed or deleted ones
+// are marked to be downloaded again. It returns the latter.
+func (f *FileWatcher) holdBack(newFiles map[string]File, revert bool) []File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.modes) == 0 {
+		f.local = nil
+		return nil
+	}
+
+	var keys []string
+	for key, file := range f.files {
+		if !f.modes.Of(file).Uploads() {
+			keys = append(keys, key)
+		}
+	}
+	for key, file := range newFiles {
+		if _, ok := f.files[key]; !ok && !f.modes.Of(file).Uploads() {
+			keys = append(keys, key)
+		}
+	}
+	// directories go before their entries
+	sort.Strings(keys)
+
+	var local = make(map[string]File)
+	var removed = make(map[string]File)
+	var reverted []File
+	for _, key := range keys {
+		oldFile, synced := f.files[key]
+		newFile, exists := newFiles[key]
+		if synced && exists && newFile.SameAs(oldFile) {
+			continue
+		}
+
+		var file = oldFile
+		if !synced {
+			file = newFile
+		}
+		var undo = revert || f.modes.Of(file) == ModeMirror
+
+		switch {
+		case !synced:
+			delete(newFiles, key)
+			if !undo {
+				local[key] = newFile
+				break
+			}
+
+			if _, ok := ancestorIn(key, removed); ok {
+				continue
+			}
+			removed[key] = newFile
+			log.Infof("%s is removed, it is not on the server", key)
+			if err := os.RemoveAll(f.path + key); err != nil {
+				log.WithError(err).Errorf("failed to remove %s", key)
+			}
+
+		case oldFile.Dir && undo:
+			newFiles[key] = oldFile
+			if err := os.MkdirAll(f.path+key, 0755); err != nil {
+				log.WithError(err).Errorf("failed to restore %s", key)
+			}
+
+		case undo:
+			// not the server copy anymore, the server sends it again
+			if oldFile.Seq != 0 || oldFile.Checksum != "" {
+				log.Infof("%s is reverted to the server copy", key)
+				oldFile.Seq, oldFile.Checksum = 0, ""
+				reverted = append(reverted, oldFile)
+				f.files[key] = oldFile
+			}
+			newFiles[key] = oldFile
+
+		default:
+			newFiles[key] = oldFile
+			if exists {
+				local[key] = newFile
+			} else {
+				local[key] = File{Path: oldFile.Path, Name: oldFile.Name, Dir: oldFile.Dir, Deleted: true}
+			}
+		}
+
+		if change, ok := local[key]; ok {
+			if known, ok := f.local[key]; !ok || known.Deleted != change.Deleted || !known.SameAs(change) {
+				log.Warnf("%s changed locally, it is not uploaded from a %s folder", key, f.modes.Of(file))
+			}
+		}
+	}
+
+	f.local = local
+	if len(reverted) > 0 {
+		f.dirty = true
+	}
+
+	return reverted
+}
@@ -0,0 +1,530 @@
+package syncbox
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/yhsiang/syncbox/pkg/websocket"
+)
+
+// ErrNotSynced is returned by a mount changing the server before it got the
+// server index.
+var ErrNotSynced = errors.New("server index not synced yet")
+
+// Mount is a view of the server index without local copies. The contents of
+// files are downloaded on first open into a Cache, and writes are uploaded
+// when the file is closed.
+type Mount struct {
+	client *SyncClient
+	cache  *Cache
+
+	mu     sync.Mutex
+	files  map[string]File
+	cursor Cursor
+	// index is the request id of the last index, whose reply is the whole
+	// server index
+	index   string
+	inodes  map[string]uint64
+	nextIno uint64
+}
+
+func NewMount(client *SyncClient, cache *Cache) *Mount {
+	return &Mount{
+		client:  client,
+		cache:   cache,
+		files:   make(map[string]File),
+		inodes:  make(map[string]uint64),
+		nextIno: 2,
+	}
+}
+
+// Connect keeps the view up to date with the server. Every connect asks for
+// the whole index, changes are pushed afterwards.
+func (m *Mount) Connect(ctx context.Context) {
+	var s = m.client
+	deviceID, err := loadDeviceID(m.cache.dir)
+	if err != nil {
+		log.WithError(err).Error("failed to load device id")
+	}
+	s.deviceID = deviceID
+
+	s.client.SetReadTimeout(60 * time.Second)
+	s.client.OnConnect(func(c *websocket.WebSocketClient) {
+		log.Infof("connected to %s", s.client.Url)
+		if err := s.hello(c, nil, []string{}); err != nil {
+			log.WithError(err).Error("failed to send hello")
+		}
+	})
+
+	s.client.OnMessage(func(msg websocket.Message) {
+		m.handle(msg.Body)
+	})
+
+	if err := s.client.Connect(ctx); err != nil {
+		log.WithError(err).Error("failed to connect")
+	}
+}
+
+func (m *Mount) handle(body []byte) {
+	var msg Message
+	if err := Unmarshal(body, &msg); err != nil {
+		log.WithError(err).Error("failed to decode message")
+		return
+	}
+	log.Debugf("receive message %+v", msg)
+
+	switch msg.Command {
+	case CommandHello:
+		if msg.Hello == nil {
+			log.Error("server answered the hello without one")
+			return
+		}
+
+		m.client.negotiate(msg.Hello)
+		if err := m.sendIndex(); err != nil {
+			log.WithError(err).Error("failed to send index")
+		}
+
+	case CommandError:
+		if msg.Error == nil {
+			log.Errorf("request %s failed", msg.ReplyTo)
+			return
+		}
+
+		log.WithError(msg.Error).Errorf("request %s failed", msg.ReplyTo)
+		if msg.Error.Code == ErrorIndexInvalidated {
+			if err := m.sendIndex(); err != nil {
+				log.WithError(err).Error("failed to send index")
+			}
+		}
+
+	case CommandAck:
+		var uploads []File
+		m.mu.Lock()
+		if msg.ReplyTo != "" && msg.ReplyTo == m.index {
+			// nothing is local, the reply lists every file
+			m.files = make(map[string]File)
+		}
+		for _, file := range msg.Files {
+			if file.Action == ActionUpload {
+				uploads = append(uploads, file)
+				continue
+			}
+			m.apply(file)
+		}
+		if msg.Cursor != nil {
+			m.cursor = *msg.Cursor
+		}
+		m.mu.Unlock()
+
+		// a file renamed onto another one is asked for, its content is in
+		// the cache since it was written here
+		for _, file := range uploads {
+			if err := m.upload(file); err != nil {
+				log.WithError(err).Errorf("failed to upload %s", file.FullName())
+			}
+		}
+	}
+}
+
+func (m *Mount) sendIndex() error {
+	var id = newRequestID()
+	m.mu.Lock()
+	m.index = id
+	m.mu.Unlock()
+
+	return m.client.write(Message{
+		Command: CommandIndex,
+		ID:      id,
+		Files:   []File{},
+	})
+}
+
+// apply follows an action of the server on the view.
+//
+// must hold the lock
+func (m *Mount) apply(file File) {
+	var key = file.FullName()
+	file.Action, file.State = "", ""
+	switch {
+	case file.Deleted:
+		m.remove(key)
+	case file.From != "":
+		m.rename(file.From, key)
+		file.From = ""
+		m.files[key] = file
+	default:
+		m.files[key] = file
+	}
+}
+
+// must hold the lock
+func (m *Mount) remove(fullName string) {
+	for key := range m.files {
+		if key == fullName || under(key, fullName) {
+			delete(m.files, key)
+		}
+	}
+}
+
+// must hold the lock
+func (m *Mount) rename(from string, to string) {
+	for key, file := range m.files {
+		if key != from && !under(key, from) {
+			continue
+		}
+
+		delete(m.files, key)
+		var dir, name = path.Split(to + key[len(from):])
+		file.Path, file.Name = dir, name
+		m.files[file.FullName()] = file
+	}
+
+	for key, ino := range m.inodes {
+		if key == from || under(key, from) {
+			delete(m.inodes, key)
+			m.inodes[to+key[len(from):]] = ino
+		}
+	}
+}
+
+// inode returns a stable inode number of fullName.
+func (m *Mount) inode(fullName string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ino, ok := m.inodes[fullName]
+	if !ok {
+		ino = m.nextIno
+		m.nextIno++
+		m.inodes[fullName] = ino
+	}
+
+	return ino
+}
+
+// Stat returns the file fullName in the view. Directories without an entry
+// of their own, e.g. on servers from before directories were synced, exist
+// as long as there are files in them.
+func (m *Mount) Stat(fullName string) (File, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if fullName == "/" {
+		return File{Path: "/", Dir: true}, true
+	}
+
+	if file, ok := m.files[fullName]; ok {
+		return file, true
+	}
+
+	for key := range m.files {
+		if under(key, fullName) {
+			var dir, name = path.Split(fullName)
+			return File{Path: dir, Name: name, Dir: true}, true
+		}
+	}
+
+	return File{}, false
+}
+
+// List returns the entries of the directory dir, "/" for the root.
+func (m *Mount) List(dir string) []File {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if dir == "/" {
+		dir = ""
+	}
+
+	var entries = make(map[string]File)
+	for key, file := range m.files {
+		if !under(key, dir) {
+			continue
+		}
+
+		var name = key[len(dir)+1:]
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			// a directory known by its entries only
+			name = name[:i]
+			if _, ok := entries[name]; !ok {
+				entries[name] = File{Path: dir + "/", Name: name, Dir: true}
+			}
+			continue
+		}
+
+		entries[name] = file
+	}
+
+	var files = []File{}
+	for _, file := range entries {
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	return files
+}
+
+// Open returns the path of the cached content of fullName, downloading it
+// first if it is not cached. The content stays in the cache until Close.
+func (m *Mount) Open(fullName string) (File, string, error) {
+	file, ok := m.Stat(fullName)
+	if !ok || file.Dir {
+		return file, "", os.ErrNotExist
+	}
+
+	if cached, ok := m.cache.Get(file.Checksum); ok {
+		return file, cached, nil
+	}
+
+	tmp, err := m.cache.TempFile()
+	if err != nil {
+		return file, "", err
+	}
+	tmp.Close()
+
+	if err := m.client.fetch(context.Background(), file, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return file, "", err
+	}
+
+	cached, err := m.cache.Put(file.Checksum, tmp.Name())
+	return file, cached, err
+}
+
+// Close lets the content opened by Open be evicted.
+func (m *Mount) Close(file File) {
+	m.cache.Release(file.Checksum)
+}
+
+// Edit returns a local copy of fullName to write to, which is uploaded by
+// Commit. The copy starts empty if trunc is set or the file is new.
+func (m *Mount) Edit(fullName string, trunc bool) (*os.File, error) {
+	tmp, err := m.cache.TempFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if file, ok := m.Stat(fullName); ok && !file.Dir && !trunc {
+		file, cached, err := m.Open(fullName)
+		if err == nil {
+			err = copyFile(tmp, cached)
+			m.Close(file)
+		}
+
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+
+	return tmp, nil
+}
+
+func copyFile(dst *os.File, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// Create adds an empty file to the view, which exists on the server once it
+// is committed.
+func (m *Mount) Create(fullName string, mode os.FileMode) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var dir, name = path.Split(fullName)
+	m.files[fullName] = File{Path: dir, Name: name, Mode: mode.Perm(), ModTime: time.Now().UnixNano()}
+}
+
+// Commit uploads the local copy tmp as fullName, and keeps it in the cache.
+func (m *Mount) Commit(fullName string, tmp *os.File) error {
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var mode = info.Mode().Perm()
+	if file, ok := m.Stat(fullName); ok && file.Mode != 0 {
+		mode = file.Mode
+	}
+
+	var dir, name = path.Split(fullName)
+	uploaded, err := m.client.post(context.Background(), [][2]string{
+		{"path", dir},
+		{"filename", name},
+		{"size", strconv.FormatInt(info.Size(), 10)},
+		{"mode", strconv.FormatUint(uint64(mode), 8)},
+		{"mtime", strconv.FormatInt(info.ModTime().UnixNano(), 10)},
+	}, name, tmp)
+	if err != nil {
+		return err
+	}
+
+	// the copy could be written to after, the cache keeps a copy of its own
+	if err := m.keep(uploaded.Checksum, tmp); err != nil {
+		log.WithError(err).Errorf("failed to cache %s", fullName)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var file = m.files[fullName]
+	file.Path, file.Name = dir, name
+	file.Checksum = uploaded.Checksum
+	file.Seq = uploaded.Seq
+	file.Size = info.Size()
+	file.Mode = mode
+	file.ModTime = info.ModTime().UnixNano()
+	m.files[fullName] = file
+	return nil
+}
+
+func (m *Mount) keep(checksum string, f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp, err := m.cache.TempFile()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, f)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if _, err := m.cache.Put(checksum, tmp.Name()); err != nil {
+		return err
+	}
+
+	m.cache.Release(checksum)
+	return nil
+}
+
+// upload sends the cached content of file, which the server asked for.
+func (m *Mount) upload(file File) error {
+	cached, ok := m.cache.Get(file.Checksum)
+	if !ok {
+		return os.ErrNotExist
+	}
+	defer m.cache.Release(file.Checksum)
+
+	f, err := os.Open(cached)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = m.client.post(context.Background(), [][2]string{
+		{"path", file.Path},
+		{"filename", file.Name},
+		{"size", strconv.FormatInt(file.Size, 10)},
+		{"mode", strconv.FormatUint(uint64(file.Mode), 8)},
+		{"mtime", strconv.FormatInt(file.ModTime, 10)},
+	}, file.Name, f)
+	return err
+}
+
+// Mkdir creates the directory fullName on the server.
+func (m *Mount) Mkdir(fullName string, mode os.FileMode) error {
+	var dir, name = path.Split(fullName)
+	if _, err := m.client.post(context.Background(), [][2]string{
+		{"path", dir},
+		{"filename", name},
+		{"dir", "true"},
+		{"mode", strconv.FormatUint(uint64(mode.Perm()), 8)},
+	}, name, nil); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[fullName] = File{Path: dir, Name: name, Dir: true, Mode: mode.Perm()}
+	return nil
+}
+
+// Remove deletes fullName, with everything under it for a directory, on the
+// server.
+func (m *Mount) Remove(fullName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[fullName]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	file.Deleted = true
+	if err := m.syn(file); err != nil {
+		return err
+	}
+
+	m.remove(fullName)
+	return nil
+}
+
+// Rename moves from to the full name to on the server.
+func (m *Mount) Rename(from string, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[from]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	var dir, name = path.Split(to)
+	file.Path, file.Name, file.From = dir, name, from
+	if err := m.syn(file); err != nil {
+		return err
+	}
+
+	m.rename(from, to)
+	return nil
+}
+
+// syn sends a change made on the view, as a client would of a local one.
+//
+// must hold the lock
+func (m *Mount) syn(change File) error {
+	if m.cursor.IndexID == "" {
+		return ErrNotSynced
+	}
+
+	var cursor = m.cursor
+	return m.client.write(Message{
+		Command: CommandSyn,
+		ID:      newRequestID(),
+		Since:   &cursor,
+		Files:   []File{change},
+	})
+}
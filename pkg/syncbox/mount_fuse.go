@@ -0,0 +1,385 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package syncbox
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Serve mounts the view at mountpoint until ctx is done.
+func (m *Mount) Serve(ctx context.Context, mountpoint string) error {
+	var timeout = time.Second
+	server, err := fs.Mount(mountpoint, &mountNode{m: m}, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:      "syncbox",
+			Name:        "syncbox",
+			DirectMount: true,
+		},
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		UID:          uint32(os.Getuid()),
+		GID:          uint32(os.Getgid()),
+	})
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Unmount(); err != nil {
+			log.WithError(err).Error("failed to unmount")
+		}
+	}()
+
+	server.Wait()
+	return nil
+}
+
+// mountNode is a file or directory of a Mount, known by its path.
+type mountNode struct {
+	fs.Inode
+	m *Mount
+}
+
+var _ = (fs.NodeLookuper)((*mountNode)(nil))
+var _ = (fs.NodeGetattrer)((*mountNode)(nil))
+var _ = (fs.NodeSetattrer)((*mountNode)(nil))
+var _ = (fs.NodeReaddirer)((*mountNode)(nil))
+var _ = (fs.NodeOpener)((*mountNode)(nil))
+var _ = (fs.NodeCreater)((*mountNode)(nil))
+var _ = (fs.NodeMkdirer)((*mountNode)(nil))
+var _ = (fs.NodeUnlinker)((*mountNode)(nil))
+var _ = (fs.NodeRmdirer)((*mountNode)(nil))
+var _ = (fs.NodeRenamer)((*mountNode)(nil))
+
+func (n *mountNode) fullName() string {
+	return "/" + n.Path(nil)
+}
+
+func (n *mountNode) child(name string) string {
+	if p := n.Path(nil); p != "" {
+		return "/" + p + "/" + name
+	}
+
+	return "/" + name
+}
+
+func (n *mountNode) newChild(ctx context.Context, fullName string, file File, out *fuse.EntryOut) *fs.Inode {
+	fillAttr(file, &out.Attr)
+	return n.NewInode(ctx, &mountNode{m: n.m}, fs.StableAttr{
+		Mode: out.Attr.Mode & syscall.S_IFMT,
+		Ino:  n.m.inode(fullName),
+	})
+}
+
+func fillAttr(file File, out *fuse.Attr) {
+	var perm = uint32(file.Mode.Perm())
+	if file.Dir {
+		if perm == 0 {
+			perm = 0755
+		}
+		out.Mode = syscall.S_IFDIR | perm
+		out.Nlink = 2
+	} else {
+		if perm == 0 {
+			perm = 0644
+		}
+		out.Mode = syscall.S_IFREG | perm
+		out.Nlink = 1
+		out.Size = uint64(file.Size)
+		out.Blocks = (out.Size + 511) / 512
+	}
+
+	if file.ModTime != 0 {
+		var modTime = time.Unix(0, file.ModTime)
+		out.SetTimes(nil, &modTime, nil)
+	}
+}
+
+func toErrno(err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return 0
+	case os.IsNotExist(err):
+		return syscall.ENOENT
+	case err == ErrQuotaExceeded:
+		return syscall.ENOSPC
+	case err == ErrNotSynced:
+		return syscall.EAGAIN
+	}
+
+	log.WithError(err).Error("mount operation failed")
+	return syscall.EIO
+}
+
+func (n *mountNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	var fullName = n.child(name)
+	file, ok := n.m.Stat(fullName)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	return n.newChild(ctx, fullName, file, out), 0
+}
+
+func (n *mountNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if h, ok := f.(*mountHandle); ok {
+		return h.Getattr(ctx, out)
+	}
+
+	file, ok := n.m.Stat(n.fullName())
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	fillAttr(file, &out.Attr)
+	return 0
+}
+
+// Setattr truncates files, other attributes are left as they are.
+func (n *mountNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if h, ok := f.(*mountHandle); ok {
+		return h.Setattr(ctx, in, out)
+	}
+
+	if size, ok := in.GetSize(); ok {
+		tmp, err := n.m.Edit(n.fullName(), size == 0)
+		if err != nil {
+			return toErrno(err)
+		}
+
+		var h = &mountHandle{m: n.m, fullName: n.fullName(), f: tmp, write: true}
+		if errno := h.Setattr(ctx, in, out); errno != 0 {
+			h.Release(ctx)
+			return errno
+		}
+
+		return h.Release(ctx)
+	}
+
+	return n.Getattr(ctx, nil, out)
+}
+
+func (n *mountNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	var entries = []fuse.DirEntry{}
+	for _, file := range n.m.List(n.fullName()) {
+		var mode uint32 = syscall.S_IFREG
+		if file.Dir {
+			mode = syscall.S_IFDIR
+		}
+
+		entries = append(entries, fuse.DirEntry{
+			Name: file.Name,
+			Mode: mode,
+			Ino:  n.m.inode(file.FullName()),
+		})
+	}
+
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *mountNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&syscall.O_ACCMODE == syscall.O_RDONLY {
+		file, cached, err := n.m.Open(n.fullName())
+		if err != nil {
+			return nil, 0, toErrno(err)
+		}
+
+		f, err := os.Open(cached)
+		if err != nil {
+			n.m.Close(file)
+			return nil, 0, toErrno(err)
+		}
+
+		return &mountHandle{m: n.m, fullName: n.fullName(), f: f, file: file}, 0, 0
+	}
+
+	tmp, err := n.m.Edit(n.fullName(), flags&syscall.O_TRUNC != 0)
+	if err != nil {
+		return nil, 0, toErrno(err)
+	}
+
+	return &mountHandle{m: n.m, fullName: n.fullName(), f: tmp, write: true, dirty: flags&syscall.O_TRUNC != 0}, 0, 0
+}
+
+func (n *mountNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	var fullName = n.child(name)
+	tmp, err := n.m.Edit(fullName, true)
+	if err != nil {
+		return nil, nil, 0, toErrno(err)
+	}
+
+	n.m.Create(fullName, os.FileMode(mode))
+	file, _ := n.m.Stat(fullName)
+	var h = &mountHandle{m: n.m, fullName: fullName, f: tmp, write: true, dirty: true}
+	return n.newChild(ctx, fullName, file, out), h, 0, 0
+}
+
+func (n *mountNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	var fullName = n.child(name)
+	if err := n.m.Mkdir(fullName, os.FileMode(mode)); err != nil {
+		return nil, toErrno(err)
+	}
+
+	file, _ := n.m.Stat(fullName)
+	return n.newChild(ctx, fullName, file, out), 0
+}
+
+func (n *mountNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	return toErrno(n.m.Remove(n.child(name)))
+}
+
+func (n *mountNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if len(n.m.List(n.child(name))) > 0 {
+		return syscall.ENOTEMPTY
+	}
+
+	return toErrno(n.m.Remove(n.child(name)))
+}
+
+func (n *mountNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	parent, ok := newParent.(*mountNode)
+	if !ok || flags != 0 {
+		return syscall.ENOTSUP
+	}
+
+	return toErrno(n.m.Rename(n.child(name), parent.child(newName)))
+}
+
+// mountHandle is an open file of a Mount, either the cached content of the
+// file or a local copy to write which is uploaded when the file is closed.
+type mountHandle struct {
+	mu       sync.Mutex
+	m        *Mount
+	fullName string
+	f        *os.File
+	// file is the one whose content is read, write is set for local copies.
+	// dirty copies are uploaded when closed, on flush only once written to
+	// since a new file is flushed before it is written on dup
+	file    File
+	write   bool
+	dirty   bool
+	written bool
+}
+
+var _ = (fs.FileReader)((*mountHandle)(nil))
+var _ = (fs.FileWriter)((*mountHandle)(nil))
+var _ = (fs.FileGetattrer)((*mountHandle)(nil))
+var _ = (fs.FileSetattrer)((*mountHandle)(nil))
+var _ = (fs.FileFlusher)((*mountHandle)(nil))
+var _ = (fs.FileReleaser)((*mountHandle)(nil))
+
+func (h *mountHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n, err := h.f.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, toErrno(err)
+	}
+
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *mountHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.write {
+		return 0, syscall.EBADF
+	}
+
+	n, err := h.f.WriteAt(data, off)
+	h.dirty, h.written = true, true
+	return uint32(n), toErrno(err)
+}
+
+func (h *mountHandle) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var file = h.file
+	if h.write {
+		file, _ = h.m.Stat(h.fullName)
+		info, err := h.f.Stat()
+		if err != nil {
+			return toErrno(err)
+		}
+		file.Size = info.Size()
+		file.ModTime = info.ModTime().UnixNano()
+	}
+
+	fillAttr(file, &out.Attr)
+	return 0
+}
+
+func (h *mountHandle) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		h.mu.Lock()
+		if !h.write {
+			h.mu.Unlock()
+			return syscall.EBADF
+		}
+
+		err := h.f.Truncate(int64(size))
+		h.dirty, h.written = true, true
+		h.mu.Unlock()
+		if err != nil {
+			return toErrno(err)
+		}
+	}
+
+	return h.Getattr(ctx, out)
+}
+
+// Flush uploads what was written, on every close of the file.
+func (h *mountHandle) Flush(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.written {
+		return 0
+	}
+
+	return h.commit()
+}
+
+// must hold the lock
+func (h *mountHandle) commit() syscall.Errno {
+	if !h.dirty {
+		return 0
+	}
+
+	if err := h.m.Commit(h.fullName, h.f); err != nil {
+		return toErrno(err)
+	}
+
+	h.dirty = false
+	return 0
+}
+
+func (h *mountHandle) Release(ctx context.Context) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var errno = h.commit()
+
+	h.f.Close()
+	if h.write {
+		os.Remove(h.f.Name())
+	} else {
+		h.m.Close(h.file)
+	}
+
+	return errno
+}
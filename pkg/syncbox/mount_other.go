@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package syncbox
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Serve is not supported where there is no FUSE.
+func (m *Mount) Serve(ctx context.Context, mountpoint string) error {
+	return errors.New("mount is only supported on linux and darwin")
+}
@@ -0,0 +1,147 @@
+package syncbox
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// PauseFolder holds syncing of a top level folder until ResumeFolder. It is
+// still indexed, but its changes are not sent and those of the server are not
+// applied.
+func (f *FileWatcher) PauseFolder(folder string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.paused == nil {
+		f.paused = make(map[string]bool)
+	}
+	f.paused[folder] = true
+}
+
+// ResumeFolder syncs a paused folder again, and tells whether it was paused.
+func (f *FileWatcher) ResumeFolder(folder string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var paused = f.paused[folder]
+	delete(f.paused, folder)
+	return paused
+}
+
+// PausedFolders returns the paused folders by name.
+func (f *FileWatcher) PausedFolders() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var folders = []string{}
+	for folder := range f.paused {
+		folders = append(folders, folder)
+	}
+
+	sort.Strings(folders)
+	return folders
+}
+
+// PausedFolder returns the paused folder file, or where it was moved from, is
+// in, if any.
+func (f *FileWatcher) PausedFolder(file File) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.paused) == 0 {
+		return "", false
+	}
+
+	if folder := FolderOf(file.accessName()); f.paused[folder] {
+		return folder, true
+	}
+
+	if folder := FolderOf(file.fromAccessName()); file.From != "" && f.paused[folder] {
+		return folder, true
+	}
+
+	return "", false
+}
+
+// parseFolder returns the name of a top level folder given with or without
+// slashes.
+func parseFolder(folder string) (string, error) {
+	folder = strings.Trim(folder, "/")
+	if folder == "" || strings.Contains(folder, "/") {
+		return "", errors.Errorf("%q is not a top level folder", folder)
+	}
+
+	return folder, nil
+}
+
+// PauseFolder holds syncing of a top level folder without disconnecting: the
+// changes of the server on it are held until ResumeFolder.
+func (s *SyncClient) PauseFolder(folder string) error {
+	folder, err := parseFolder(folder)
+	if err != nil {
+		return err
+	}
+
+	s.fileWatcher.PauseFolder(folder)
+	// the reconciliation on resume transfers what is still needed
+	s.transfers.Cancel("/" + folder)
+	log.Infof("%s paused", folder)
+	return nil
+}
+
+// ResumeFolder syncs a paused folder again. What changed on either side
+// meanwhile is reconciled at once by the full index, in place of the held
+// changes of the server.
+func (s *SyncClient) ResumeFolder(folder string) error {
+	folder, err := parseFolder(folder)
+	if err != nil {
+		return err
+	}
+
+	if !s.fileWatcher.ResumeFolder(folder) {
+		return nil
+	}
+
+	s.mu.Lock()
+	var held = len(s.held[folder])
+	delete(s.held, folder)
+	ready := s.ready
+	s.mu.Unlock()
+
+	log.Infof("%s resumed, reconciling %d held changes", folder, held)
+	if !ready {
+		// the index sent on connecting reconciles
+		return nil
+	}
+
+	return s.sendIndex()
+}
+
+// hold keeps a change of the server on a paused folder from being applied,
+// and tells whether it did.
+func (s *SyncClient) hold(file File) bool {
+	folder, paused := s.fileWatcher.PausedFolder(file)
+	if !paused {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.held == nil {
+		s.held = make(map[string][]File)
+	}
+	s.held[folder] = append(s.held[folder], file)
+	return true
+}
+
+// heldCount returns the number of changes of the server held for folder.
+func (s *SyncClient) heldCount(folder string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.held[folder])
+}
@@ -0,0 +1,136 @@
+package syncbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// StatusQuotaExceeded is the http status of an upload rejected by a quota.
+const StatusQuotaExceeded = http.StatusInsufficientStorage
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ErrUnownedFile refuses files directly under the root while users have
+// quotas, nobody owns them to be charged for them.
+var ErrUnownedFile = errors.New("files directly under the root count against no quota, write them in a folder")
+
+// Quotas limits in bytes how much a user may own and how large a folder may
+// grow. Users and folders not listed are unlimited.
+type Quotas struct {
+	Users   map[string]int64 `json:"users"`
+	Folders map[string]int64 `json:"folders"`
+}
+
+func LoadQuotas(path string) (*Quotas, error) {
+	var quotas = &Quotas{
+		Users:   make(map[string]int64),
+		Folders: make(map[string]int64),
+	}
+
+	if path == "" {
+		return quotas, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, quotas); err != nil {
+		return nil, err
+	}
+
+	return quotas, nil
+}
+
+type Usage struct {
+	Name  string `json:"name"`
+	Used  int64  `json:"used"`
+	Limit int64  `json:"limit"`
+}
+
+func (u Usage) Exceeded(size int64) bool {
+	return u.Limit > 0 && u.Used+size > u.Limit
+}
+
+func (q *Quotas) FolderUsage(fileWatcher *FileWatcher, folder string) Usage {
+	return Usage{
+		Name:  folder,
+		Used:  fileWatcher.Usage(folder),
+		Limit: q.Folders[folder],
+	}
+}
+
+// UserUsage sums up the folders user owns.
+func (q *Quotas) UserUsage(fileWatcher *FileWatcher, shares *ShareStore, user string) Usage {
+	var usage = Usage{
+		Name:  user,
+		Limit: q.Users[user],
+	}
+
+	for _, folder := range shares.Folders(user) {
+		if shares.Owner(folder) == user {
+			usage.Used += fileWatcher.Usage(folder)
+		}
+	}
+
+	return usage
+}
+
+// Check returns ErrQuotaExceeded if writing size bytes to fullName would go
+// over the quota of its folder or of the folder owner. A folder nobody owns
+// yet is charged to user, who is about to claim it. Files directly under the
+// root are refused while users have quotas, see ErrUnownedFile.
+func (q *Quotas) Check(fileWatcher *FileWatcher, shares *ShareStore, user string, fullName string, size int64) error {
+	var folder = FolderOf(fullName)
+	if folder == "" && len(q.Users) > 0 {
+		return ErrUnownedFile
+	}
+
+	// the file being replaced frees its own size
+	if old, ok := fileWatcher.Get(fullName); ok {
+		size -= old.Size
+	}
+
+	if q.FolderUsage(fileWatcher, folder).Exceeded(size) {
+		return ErrQuotaExceeded
+	}
+
+	var owner = shares.Owner(folder)
+	if owner == "" {
+		owner = user
+	}
+
+	if q.UserUsage(fileWatcher, shares, owner).Exceeded(size) {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// Limited tells whether a quota applies to writing fullName, of its folder or
+// of the folder owner.
+func (q *Quotas) Limited(shares *ShareStore, user string, fullName string) bool {
+	var folder = FolderOf(fullName)
+	if q.Folders[folder] > 0 || folder == "" && len(q.Users) > 0 {
+		return true
+	}
+
+	var owner = shares.Owner(folder)
+	if owner == "" {
+		owner = user
+	}
+
+	return q.Users[owner] > 0
+}
+
+// Status is the usage report served to `syncbox status`.
+type Status struct {
+	User    Usage   `json:"user"`
+	Folders []Usage `json:"folders"`
+	// Bandwidth are the limits of the server
+	Bandwidth *BandwidthStatus `json:"bandwidth,omitempty"`
+}
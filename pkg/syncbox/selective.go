@@ -0,0 +1,272 @@
+package syncbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/apex/log"
+)
+
+// Selection is the part of the server tree a client mirrors. A path is synced
+// by the most specific rule covering it, or if there are no includes by
+// default. Directories leading to an include are synced too, without the
+// files in them.
+type Selection struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+func selectionPath(root string) string {
+	return stateDirPath(root) + "/selective.json"
+}
+
+// LoadSelection reads the selection of the client at root, nil if it mirrors
+// everything.
+func LoadSelection(root string) (*Selection, error) {
+	data, err := ioutil.ReadFile(selectionPath(root))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s Selection
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// Save writes the selection of the client at root, which a running client
+// picks up on its next scan.
+func (s *Selection) Save(root string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if _, err := ensureStateDir(root); err != nil {
+		return err
+	}
+
+	var tmp = selectionPath(root) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, selectionPath(root))
+}
+
+func covers(rule string, fullName string) bool {
+	return rule == "/" || rule == fullName || under(fullName, rule)
+}
+
+// Selected tells whether the file fullName is synced, a nil selection syncs
+// everything.
+func (s *Selection) Selected(fullName string, dir bool) bool {
+	if s == nil {
+		return true
+	}
+
+	if dir {
+		for _, rule := range s.Include {
+			if under(rule, fullName) {
+				return true
+			}
+		}
+	}
+
+	var selected, best = len(s.Include) == 0, ""
+	for _, rule := range s.Include {
+		if covers(rule, fullName) && len(rule) > len(best) {
+			selected, best = true, rule
+		}
+	}
+
+	for _, rule := range s.Exclude {
+		if covers(rule, fullName) && len(rule) >= len(best) {
+			selected, best = false, rule
+		}
+	}
+
+	return selected
+}
+
+// Add syncs fullName and everything under it.
+func (s *Selection) Add(fullName string) {
+	fullName = path.Clean("/" + fullName)
+	s.clear(fullName)
+	if !s.Selected(fullName, false) {
+		s.Include = append(s.Include, fullName)
+		sort.Strings(s.Include)
+	}
+}
+
+// Remove stops syncing fullName and everything under it.
+func (s *Selection) Remove(fullName string) {
+	fullName = path.Clean("/" + fullName)
+	s.clear(fullName)
+	if s.Selected(fullName, false) {
+		s.Exclude = append(s.Exclude, fullName)
+		sort.Strings(s.Exclude)
+	}
+}
+
+// clear drops the rules on fullName and under it.
+func (s *Selection) clear(fullName string) {
+	var keep = func(rules []string) []string {
+		var kept []string
+		for _, rule := range rules {
+			if !covers(fullName, rule) {
+				kept = append(kept, rule)
+			}
+		}
+		return kept
+	}
+
+	s.Include = keep(s.Include)
+	s.Exclude = keep(s.Exclude)
+}
+
+// EnableSelection makes the watcher index only the selected paths, and
+// follow the selection saved under the state directory.
+func (f *FileWatcher) EnableSelection() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.selective = true
+}
+
+// Selection returns the selection the watcher indexes by.
+func (f *FileWatcher) Selection() *Selection {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.selection
+}
+
+// reloadSelection reads the selection again if it was saved since, and
+// evicts the local copies of files no longer selected.
+func (f *FileWatcher) reloadSelection() (bool, error) {
+	if !f.selective {
+		return false, nil
+	}
+
+	var modTime int64
+	if info, err := os.Stat(selectionPath(f.path)); err == nil {
+		modTime = info.ModTime().UnixNano()
+	}
+
+	f.mu.Lock()
+	var loaded = f.selectionLoaded && modTime == f.selectionModTime
+	f.mu.Unlock()
+	if loaded {
+		return false, nil
+	}
+
+	selection, err := LoadSelection(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.selection = selection
+	f.selectionModTime = modTime
+	f.selectionLoaded = true
+	f.evict()
+	return true, nil
+}
+
+// evict removes from the index, and from disk unless they changed since, the
+// files which are not selected. They are not changes, the server keeps them.
+//
+// must hold the lock
+func (f *FileWatcher) evict() {
+	var dirs []string
+	for key, file := range f.files {
+		if f.selection.Selected(key, file.Dir) {
+			continue
+		}
+
+		delete(f.files, key)
+		delete(f.downloads, file.ID)
+		f.dirty = true
+
+		if file.Dir {
+			dirs = append(dirs, key)
+			continue
+		}
+
+		var local = file
+		if file.Link == "" {
+			if err := local.CalChecksum(f.hash); err != nil || !local.SameAs(file) {
+				log.Warnf("%s is kept, it changed locally since it was synced", key)
+				continue
+			}
+		}
+
+		if err := os.Remove(f.path + key); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Errorf("failed to evict %s", key)
+		}
+	}
+
+	// deepest first, directories with local files in them stay
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		os.Remove(f.path + dir)
+	}
+}
+
+// selectFiles drops the actions on files outside the selection of a client.
+// Moves between a selected path and one which is not are a download or a
+// delete.
+func selectFiles(selection *Selection, fileWatcher *FileWatcher, files FileSlice) FileSlice {
+	if selection == nil {
+		return files
+	}
+
+	var selected = FileSlice{}
+	for _, file := range files {
+		var in = selection.Selected(file.FullName(), file.Dir)
+		switch file.Action {
+		case ActionMove:
+			var fromIn = selection.Selected(file.From, file.Dir)
+			switch {
+			case in && !fromIn && file.Dir:
+				for _, entry := range fileWatcher.Tree(file.FullName()) {
+					if selection.Selected(entry.FullName(), entry.Dir) {
+						entry.Action = ActionDownload
+						entry.From = ""
+						selected = append(selected, entry)
+					}
+				}
+				continue
+			case in && !fromIn:
+				file.Action = ActionDownload
+				file.From = ""
+			case !in && fromIn:
+				var dir, name = path.Split(file.From)
+				file = File{Path: dir, Name: name, Checksum: file.Checksum, Seq: file.Seq, Dir: file.Dir, Deleted: true, Action: ActionDelete}
+				in = true
+			}
+
+		case ActionDownload, ActionDelete:
+		default:
+			// the changes of the client itself
+			in = true
+		}
+
+		if in {
+			selected = append(selected, file)
+		}
+	}
+
+	return selected
+}
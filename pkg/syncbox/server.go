@@ -2,8 +2,9 @@ package syncbox
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"os"
+	"path"
 
 	"github.com/apex/log"
 )
@@ -13,30 +14,295 @@ var Port = "3000"
 var WsUrl = fmt.Sprintf("ws://%s:%s", Host, Port)
 var ServerUrl = fmt.Sprintf("http://%s:%s", Host, Port)
 
-func NewServer(ctx context.Context, addr string, fileWatcher *FileWatcher) *SyncServer {
-	server := NewSyncServer(ctx, addr, fileWatcher)
+func NewServer(ctx context.Context, addr string, fileWatcher *FileWatcher, access *Access, links *LinkStore, versions *VersionStore) *SyncServer {
+	server := NewSyncServer(ctx, addr, fileWatcher, access, links, versions)
+	fileWatcher.EnableSequence()
+
+	// reply tells the client what to do, and removes and moves on the server
+	// the files the client deleted and moved.
+	reply := func(conn *SyncConnection, msg Message, res Resolution) {
+		var actions = res.Actions
+		for _, file := range res.Removals {
+			if !access.Permission(conn.user, file.accessName()).CanWrite() {
+				file.Action = ActionRevert
+				actions = append(actions, file)
+				continue
+			}
+
+			var archived = FileSlice{file}
+			if file.Dir {
+				archived = fileWatcher.List(file.FullName())
+			}
+
+			for _, file := range archived {
+				if err := versions.Archive(file.FullName()); err != nil {
+					log.WithError(err).Error("failed to archive version")
+				}
+			}
+
+			if err := os.RemoveAll(fileWatcher.path + file.FullName()); err != nil {
+				log.WithError(err).Error("failed to remove file")
+			}
+		}
+
+		for _, file := range res.Moves {
+			if err := move(access, fileWatcher, conn.user, file); err != nil {
+				log.WithError(err).Warnf("failed to move %s to %s", file.From, file.FullName())
+
+				// undo the move on the client, the upload is rejected or
+				// reverted if the user could not write there either
+				if source, ok := fileWatcher.Get(file.From); ok {
+					var restored = FileSlice{source}
+					if source.Dir {
+						restored = fileWatcher.Tree(source.FullName())
+					}
+
+					for _, source := range restored {
+						source.Action = ActionRevert
+						actions = append(actions, source)
+					}
+				}
+
+				file.Action = ActionUpload
+				file.From = ""
+				actions = append(actions, file)
+			}
+		}
+
+		conn.Write(Message{
+			Command: CommandAck,
+			ReplyTo: msg.ID,
+			Cursor:  &res.Cursor,
+			Files:   selectFiles(conn.Selection(), fileWatcher, dropLinks(conn, authorize(access, fileWatcher, conn.user, actions))),
+		})
+
+		if len(res.Removals) > 0 || len(res.Moves) > 0 {
+			// tell the other clients right away
+			if err := fileWatcher.WalkDir(); err != nil {
+				log.WithError(err).Error("failed to scan after removals")
+			}
+		}
+	}
+
 	server.OnMessage(func(conn *SyncConnection, message []byte) {
-		log.Infof("receive message %s", message)
 		var msg Message
-		err := json.Unmarshal(message, &msg)
+		err := Unmarshal(message, &msg)
 		if err != nil {
-			log.WithError(err).Error("failed to decode json")
+			log.WithError(err).Error("failed to decode message")
+			conn.Write(NewErrorMessage("", ErrorBadMessage, "failed to decode message: %v", err))
+			return
 		}
+		log.Infof("receive message %+v", msg)
 
-		switch msg.Command {
-		case "syn":
-			files := fileWatcher.Compare(msg.Files)
-			conn.WriteJSON(Message{
-				Command: "ack",
-				Files:   files,
-			})
+		if msg.Command != CommandHello && conn.Hello() == nil {
+			conn.Write(NewErrorMessage(msg.ID, ErrorHelloRequired, "send hello before %s", msg.Command))
+			return
 		}
 
+		switch msg.Command {
+		case CommandHello:
+			if msg.Hello == nil || msg.Hello.Version != ProtocolVersion {
+				var version = 0
+				if msg.Hello != nil {
+					version = msg.Hello.Version
+				}
+
+				conn.Write(NewErrorMessage(msg.ID, ErrorIncompatibleVersion, "protocol version %d is not supported, expect %d", version, ProtocolVersion))
+				conn.Close()
+				return
+			}
+
+			var algorithm = fileWatcher.Hash()
+			if !msg.Hello.HasHash(algorithm) {
+				conn.Write(NewErrorMessage(msg.ID, ErrorUnsupportedHash, "the index is of %s checksums, which the client does not compute", algorithm))
+				conn.Close()
+				return
+			}
+
+			var capabilities = []string{CapabilityPush, algorithm.Capability()}
+			if msg.Hello.Has(CapabilityMsgpack) {
+				capabilities = append(capabilities, CapabilityMsgpack)
+			}
+			if msg.Hello.Has(CapabilityGzip) {
+				capabilities = append(capabilities, CapabilityGzip)
+			}
+			if fileWatcher.SymlinkPolicy() == SymlinkLink {
+				capabilities = append(capabilities, CapabilitySymlinks)
+				conn.SetLinks(msg.Hello.Has(CapabilitySymlinks))
+			}
+
+			// the hello is answered in json, everything after in msgpack
+			var encoding = EncodingJSON
+			if msg.Hello.Has(CapabilityMsgpack) {
+				encoding = EncodingMsgpack
+			}
+
+			conn.Greet(msg.Hello, Message{
+				Command: CommandHello,
+				ReplyTo: msg.ID,
+				Hello: &Hello{
+					Version:      ProtocolVersion,
+					Folders:      access.Folders(conn.user),
+					Capabilities: capabilities,
+				},
+			}, encoding)
+
+		case CommandIndex:
+			conn.SetSelection(msg.Selection)
+			reply(conn, msg, fileWatcher.Full(msg.Files))
+
+		case CommandSyn:
+			if msg.Since == nil || !fileWatcher.Covers(*msg.Since) {
+				conn.Write(NewErrorMessage(msg.ID, ErrorIndexInvalidated, "cursor is not of the server index or older than its tombstones, send the full index"))
+				return
+			}
+
+			reply(conn, msg, fileWatcher.Delta(msg.Since.Seq, msg.Files))
+
+		default:
+			conn.Write(NewErrorMessage(msg.ID, ErrorUnknownCommand, "unknown command %q", msg.Command))
+		}
 	})
 
+	// push the changes on the server, e.g. uploads and webdav writes, to every
+	// client which could read them.
 	fileWatcher.OnChange(func(files []File) {
 		log.Infof("file changed %+v", files)
+		for _, conn := range server.Connections() {
+			if conn.Hello() == nil {
+				continue
+			}
+
+			var actions = FileSlice{}
+			for _, file := range files {
+				switch file.State {
+				case "new", "update":
+					file.Action = ActionDownload
+				case "move":
+					file.Action = ActionMove
+				case "delete":
+					file.Action = ActionDelete
+				}
+				actions = append(actions, file)
+			}
+			actions = selectFiles(conn.Selection(), fileWatcher, dropLinks(conn, authorize(access, fileWatcher, conn.user, actions)))
+
+			if len(actions) == 0 {
+				continue
+			}
+
+			var cursor = fileWatcher.Cursor()
+			if err := conn.Write(Message{Command: CommandAck, Cursor: &cursor, Files: actions}); err != nil {
+				log.WithError(err).Error("failed to push changes")
+			}
+		}
 	})
 
 	return server
 }
+
+// dropLinks leaves out links unless both the client and the server sync them
+// as links, the client neither gets them nor is asked to upload them.
+func dropLinks(conn *SyncConnection, files FileSlice) FileSlice {
+	if conn.Links() {
+		return files
+	}
+
+	var kept = FileSlice{}
+	for _, file := range files {
+		if file.Link == "" {
+			kept = append(kept, file)
+		}
+	}
+
+	return kept
+}
+
+// move renames a file on the server as a client did, if the user could write
+// to both places.
+func move(access *Access, fileWatcher *FileWatcher, user string, file File) error {
+	// the names come from the client, see cleanName
+	from, ok := cleanName(file.From)
+	if !ok {
+		return ErrInvalidName
+	}
+
+	to, ok := cleanName(file.FullName())
+	if !ok {
+		return ErrInvalidName
+	}
+
+	file.From = from
+	file.Path, file.Name = path.Split(to)
+	if !access.Permission(user, file.fromAccessName()).CanWrite() || !access.Permission(user, file.accessName()).CanWrite() {
+		return ErrNotPermitted
+	}
+
+	if FolderOf(file.fromAccessName()) != FolderOf(file.accessName()) {
+		var size = file.Size
+		for _, moved := range fileWatcher.List(file.From) {
+			size += moved.Size
+		}
+
+		if err := access.CheckQuota(fileWatcher, user, file.accessName(), size); err != nil {
+			return err
+		}
+	}
+
+	if err := access.Claim(user, file.accessName()); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(fileWatcher.path+file.Path, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(fileWatcher.path+file.From, fileWatcher.path+file.FullName())
+}
+
+// authorize drops actions on folders the user could not access. Uploads to
+// read-only folders are rejected, or reverted to the server copy if the server
+// has the file. Moves between a folder the user could read and one it could
+// not are a download or a delete.
+func authorize(access *Access, fileWatcher *FileWatcher, user string, actions FileSlice) FileSlice {
+	var authorized = FileSlice{}
+	for _, file := range actions {
+		perm := access.Permission(user, file.accessName())
+		if file.Action == ActionMove && !access.Permission(user, file.fromAccessName()).CanRead() {
+			if file.Dir && perm.CanRead() {
+				// the entries of the directory were never sent on their own
+				for _, entry := range fileWatcher.Tree(file.FullName()) {
+					entry.Action = ActionDownload
+					entry.From = ""
+					authorized = append(authorized, entry)
+				}
+				continue
+			}
+
+			file.Action = ActionDownload
+			file.From = ""
+		}
+
+		if file.Action == ActionMove && !perm.CanRead() {
+			var dir, name = path.Split(file.From)
+			file = File{Path: dir, Name: name, Checksum: file.Checksum, Seq: file.Seq, Dir: file.Dir, Deleted: true, Action: ActionDelete}
+			perm = access.Permission(user, file.accessName())
+		}
+
+		if !perm.CanRead() {
+			continue
+		}
+
+		if file.Action == ActionUpload && !perm.CanWrite() {
+			file.Action = ActionReject
+			if serverFile, ok := fileWatcher.Get(file.FullName()); ok {
+				file = serverFile
+				file.Action = ActionRevert
+			}
+		}
+
+		authorized = append(authorized, file)
+	}
+
+	return authorized
+}
@@ -0,0 +1,194 @@
+package syncbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type Permission string
+
+const (
+	NoAccess  Permission = "none"
+	ReadOnly  Permission = "ro"
+	ReadWrite Permission = "rw"
+)
+
+func (p Permission) CanRead() bool {
+	return p == ReadOnly || p == ReadWrite
+}
+
+func (p Permission) CanWrite() bool {
+	return p == ReadWrite
+}
+
+func ParsePermission(s string) (Permission, error) {
+	switch p := Permission(s); p {
+	case NoAccess, ReadOnly, ReadWrite:
+		return p, nil
+	}
+
+	return NoAccess, errors.Errorf("unknown permission %q, expect one of none, ro, rw", s)
+}
+
+var ErrNotOwner = errors.New("only the folder owner can change its shares")
+var ErrNotPermitted = errors.New("permission denied")
+
+// Share is a top level folder owned by one user and shared with others.
+type Share struct {
+	Owner   string                `json:"owner"`
+	Members map[string]Permission `json:"members"`
+}
+
+// ShareStore keeps the shares of all folders and persists them as json under
+// the state directory of the server root.
+type ShareStore struct {
+	mu     sync.Mutex
+	path   string
+	shares map[string]*Share
+}
+
+func NewShareStore(root string) (*ShareStore, error) {
+	dir, err := ensureStateDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var s = &ShareStore{
+		path:   dir + "/shares.json",
+		shares: make(map[string]*Share),
+	}
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.shares); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Permission of user on folder. Files directly under the root and folders
+// nobody owns yet are open to every user.
+func (s *ShareStore) Permission(user string, folder string) Permission {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if folder == "" {
+		return ReadWrite
+	}
+
+	share, ok := s.shares[folder]
+	if !ok {
+		return ReadWrite
+	}
+
+	if share.Owner == user {
+		return ReadWrite
+	}
+
+	if perm, ok := share.Members[user]; ok {
+		return perm
+	}
+
+	return NoAccess
+}
+
+// Owner returns the owner of folder, empty if nobody owns it.
+func (s *ShareStore) Owner(folder string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if share, ok := s.shares[folder]; ok {
+		return share.Owner
+	}
+
+	return ""
+}
+
+// Folders returns the folders user owns or is a member of.
+func (s *ShareStore) Folders(user string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var folders = []string{}
+	for folder, share := range s.shares {
+		if _, ok := share.Members[user]; ok || share.Owner == user {
+			folders = append(folders, folder)
+		}
+	}
+
+	sort.Strings(folders)
+	return folders
+}
+
+func (s *ShareStore) Claim(user string, folder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if folder == "" {
+		return nil
+	}
+
+	if _, ok := s.shares[folder]; ok {
+		return nil
+	}
+
+	s.shares[folder] = &Share{
+		Owner:   user,
+		Members: make(map[string]Permission),
+	}
+
+	return s.save()
+}
+
+// Grant gives user perm on folder, NoAccess revokes it. A folder nobody owns
+// yet is claimed by owner.
+func (s *ShareStore) Grant(owner string, folder string, user string, perm Permission) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if folder == "" {
+		return errors.New("files under the root could not be shared")
+	}
+
+	share, ok := s.shares[folder]
+	if !ok {
+		share = &Share{
+			Owner:   owner,
+			Members: make(map[string]Permission),
+		}
+		s.shares[folder] = share
+	}
+
+	if share.Owner != owner {
+		return ErrNotOwner
+	}
+
+	if perm == NoAccess {
+		delete(share.Members, user)
+	} else {
+		share.Members[user] = perm
+	}
+
+	return s.save()
+}
+
+func (s *ShareStore) save() error {
+	data, err := json.MarshalIndent(s.shares, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.path, data, 0644)
+}
@@ -0,0 +1,42 @@
+package syncbox
+
+import (
+	"context"
+	"net/http"
+)
+
+// shareHandler lets the owner of a folder grant other users access to it.
+type shareHandler struct {
+	context     context.Context
+	fileWatcher *FileWatcher
+	access      *Access
+}
+
+func (h *shareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	user, ok := h.access.Authenticate(r)
+	if !ok || !h.access.Enabled() {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	perm, err := ParsePermission(r.FormValue("permission"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.access.Grant(h.fileWatcher, user, r.FormValue("folder"), r.FormValue("user"), perm)
+	if err == ErrNotOwner {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
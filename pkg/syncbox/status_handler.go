@@ -0,0 +1,29 @@
+package syncbox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+type statusHandler struct {
+	context     context.Context
+	server      *SyncServer
+	fileWatcher *FileWatcher
+	access      *Access
+}
+
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.access.Authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var status = h.access.Status(h.fileWatcher, user)
+	var bandwidth = h.server.Bandwidth()
+	status.Bandwidth = &bandwidth
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
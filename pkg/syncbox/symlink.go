@@ -0,0 +1,179 @@
+package syncbox
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// SymlinkPolicy is what a FileWatcher makes of symbolic links.
+type SymlinkPolicy string
+
+const (
+	// SymlinkIgnore leaves links out of the index.
+	SymlinkIgnore SymlinkPolicy = "ignore"
+	// SymlinkLink syncs links as links, by their target.
+	SymlinkLink SymlinkPolicy = "link"
+	// SymlinkFollow syncs what links point to as regular files and
+	// directories, as long as it is within the root.
+	SymlinkFollow SymlinkPolicy = "follow"
+)
+
+// CapabilitySymlinks is announced by clients and servers which recreate links
+// as links.
+const CapabilitySymlinks = "symlinks"
+
+func ParseSymlinkPolicy(s string) (SymlinkPolicy, error) {
+	switch p := SymlinkPolicy(s); p {
+	case SymlinkIgnore, SymlinkLink, SymlinkFollow:
+		return p, nil
+	}
+
+	return SymlinkIgnore, errors.Errorf("unknown symlink policy %q, expect one of ignore, link, follow", s)
+}
+
+// SetSymlinkPolicy chooses what to do with links, before the first scan.
+func (f *FileWatcher) SetSymlinkPolicy(policy SymlinkPolicy) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.symlinks = policy
+}
+
+// SymlinkPolicy returns what the watcher does with links.
+func (f *FileWatcher) SymlinkPolicy() SymlinkPolicy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.symlinks
+}
+
+// linkChecksum is the checksum of a link, which is its target.
+func linkChecksum(target string, algorithm HashAlgorithm) string {
+	return algorithm.Sum([]byte("link:" + target))
+}
+
+// walkLink indexes the link at path as fullName by the policy. root is the
+// resolved root, and visited the resolved directories walked already.
+func (f *FileWatcher) walkLink(newFiles map[string]File, path string, fullName string, root string, visited map[string]bool) error {
+	var dir, name = filepath.Split(fullName)
+	switch f.SymlinkPolicy() {
+	case SymlinkLink:
+		target, err := os.Readlink(path)
+		if err != nil {
+			log.WithError(err).Errorf("failed to read link %s", fullName)
+			return nil
+		}
+
+		newFiles[fullName] = File{
+			Name:     name,
+			RootPath: f.path,
+			Path:     dir,
+			Checksum: linkChecksum(target, f.Hash()),
+			Link:     target,
+			ID:       ID(uuid.New().String()),
+		}
+
+	case SymlinkFollow:
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil || !within(resolved, root) || within(resolved, root+"/"+StateDir) {
+			if !f.skipped[fullName] {
+				log.Warnf("link %s is skipped, it does not point to a file within the root", fullName)
+			}
+			f.skipped[fullName] = true
+			return nil
+		}
+
+		info, err := os.Stat(resolved)
+		if err != nil {
+			return nil
+		}
+
+		if !info.IsDir() {
+			return f.walkFile(newFiles, fullName, info)
+		}
+
+		// links could point to where they are, walk every directory once
+		if visited[resolved] {
+			return nil
+		}
+		visited[resolved] = true
+
+		newFiles[fullName] = File{
+			Name:     name,
+			RootPath: f.path,
+			Path:     dir,
+			Dir:      true,
+			Mode:     info.Mode().Perm(),
+			ID:       ID(uuid.New().String()),
+		}
+		return f.walk(newFiles, resolved, fullName, root, visited)
+	}
+
+	return nil
+}
+
+func within(path string, dir string) bool {
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// linkWithin tells whether a link at fullName to target points within the top
+// level folder of the link, so that it never leads to the folders of other
+// users, out of the root or into the state directory. Absolute targets never
+// do, nor do links directly under the root, which belong to no folder.
+func linkWithin(fullName string, target string) bool {
+	var folder = FolderOf(fullName)
+	if folder == "" || target == "" || path.IsAbs(target) || filepath.IsAbs(target) {
+		return false
+	}
+
+	var resolved = path.Join(strings.TrimPrefix(path.Dir(fullName), "/"), target)
+	return resolved == folder || strings.HasPrefix(resolved, folder+"/")
+}
+
+// throughLink tells whether fullName under root is reached through a link,
+// which the server must not follow on behalf of a user.
+func throughLink(root string, fullName string) bool {
+	var dir = root
+	for _, part := range strings.Split(strings.Trim(path.Dir(path.Clean("/"+fullName)), "/"), "/") {
+		if part == "" {
+			continue
+		}
+
+		dir += "/" + part
+		info, err := os.Lstat(dir)
+		if err != nil {
+			// the rest does not exist yet
+			return false
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLink tells whether fullPath is a link.
+func isLink(fullPath string) bool {
+	info, err := os.Lstat(fullPath)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// createLink replaces whatever is at fullPath with a link to target.
+func createLink(fullPath string, target string) error {
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Symlink(target, fullPath)
+}
@@ -11,8 +11,14 @@ import (
 type SyncConnection struct {
 	mu sync.Mutex
 	*websocket.Conn
-	context context.Context
-	server  *SyncServer
+	context  context.Context
+	server   *SyncServer
+	user     string
+	hello    *Hello
+	encoding Encoding
+	links    bool
+	// selection is the one of the last index, nil for everything
+	selection *Selection
 }
 
 // read handles messages from client and send it to messageCallbacks of server.
@@ -52,3 +58,67 @@ func (c *SyncConnection) WriteJSON(data interface{}) error {
 
 	return nil
 }
+
+// Write sends msg in the encoding negotiated with the client.
+func (c *SyncConnection) Write(msg Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	messageType, data, err := c.encoding.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteMessage(messageType, data)
+}
+
+// Links tells whether links are synced as links with the client.
+func (c *SyncConnection) Links() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.links
+}
+
+func (c *SyncConnection) SetLinks(links bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.links = links
+}
+
+// Selection returns what the client mirrors, nil for everything.
+func (c *SyncConnection) Selection() *Selection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.selection
+}
+
+func (c *SyncConnection) SetSelection(selection *Selection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.selection = selection
+}
+
+// Hello returns the hello of the client, nil before the handshake.
+func (c *SyncConnection) Hello() *Hello {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hello
+}
+
+// Greet records the hello of the client and answers it with reply, in json
+// like every hello. Messages after it go in encoding, which is switched under
+// the same lock, so that none goes in between in the wrong one.
+func (c *SyncConnection) Greet(hello *Hello, reply Message, encoding Encoding) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hello = hello
+	c.encoding = encoding
+
+	messageType, data, err := EncodingJSON.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteMessage(messageType, data)
+}
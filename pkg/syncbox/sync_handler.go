@@ -10,9 +10,16 @@ import (
 type syncHandler struct {
 	context context.Context
 	server  *SyncServer
+	access  *Access
 }
 
 func (h *syncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.access.Authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	rawConn, err := h.upgradeConn(w, r)
 	if err != nil {
 		return
@@ -20,11 +27,16 @@ func (h *syncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	var ctx = r.Context()
 	var conn = &SyncConnection{
-		Conn:    rawConn,
-		context: ctx,
-		server:  h.server,
+		Conn:     rawConn,
+		context:  ctx,
+		server:   h.server,
+		user:     user,
+		encoding: EncodingJSON,
 	}
 
+	h.server.addConnection(conn)
+	defer h.server.removeConnection(conn)
+
 	if err := conn.read(ctx); err != nil {
 		if websocket.IsUnexpectedCloseError(err, websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure) {
 			return
@@ -34,8 +46,9 @@ func (h *syncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (h *syncHandler) upgradeConn(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
 	var upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: true,
 	}
 
 	return upgrader.Upgrade(w, r, nil)
@@ -2,35 +2,170 @@ package syncbox
 
 import (
 	"context"
+	"io"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
 //go:generate callbackgen -type SyncServer
 type SyncServer struct {
 	*http.Server
 
+	mu    sync.Mutex
+	conns map[*SyncConnection]struct{}
+
+	// limits throttle transfers, upload and download are shared by all
+	// connections
+	limits   Limits
+	upload   *Limiter
+	download *Limiter
+
 	messageCallbacks []func(conn *SyncConnection, message []byte)
 	// uploadCallbacks []
 }
 
-func NewSyncServer(ctx context.Context, addr string, fileWatcher *FileWatcher) *SyncServer {
+func NewSyncServer(ctx context.Context, addr string, fileWatcher *FileWatcher, access *Access, links *LinkStore, versions *VersionStore) *SyncServer {
 	var server = &SyncServer{
 		Server: &http.Server{
 			Addr: addr,
 		},
+		conns: make(map[*SyncConnection]struct{}),
+	}
+
+	server.Server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+
+		return context.WithValue(ctx, connLimitersKey{}, &connLimiters{
+			upload:   NewLimiter(server.limits.ConnUpload),
+			download: NewLimiter(server.limits.ConnDownload),
+		})
 	}
 
 	var mux = http.NewServeMux()
 	mux.Handle("/", &syncHandler{
 		context: ctx,
 		server:  server,
+		access:  access,
 	})
 
-	mux.Handle("/upload", &uploadHandler{
+	mux.Handle("/upload", server.limit(&uploadHandler{
+		context:     ctx,
+		fileWatcher: fileWatcher,
+		access:      access,
+		versions:    versions,
+	}))
+
+	mux.Handle("/download/", server.limit(&downloadHandler{
+		context:     ctx,
+		fileWatcher: fileWatcher,
+		access:      access,
+	}))
+
+	mux.Handle("/links", &linkHandler{
 		context:     ctx,
 		fileWatcher: fileWatcher,
+		access:      access,
+		links:       links,
+	})
+
+	mux.Handle("/s/", server.limit(&publicLinkHandler{
+		context:     ctx,
+		fileWatcher: fileWatcher,
+		access:      access,
+		links:       links,
+	}))
+
+	mux.Handle("/web/", server.limit(newWebHandler(ctx, fileWatcher, access, versions)))
+
+	mux.Handle(davPrefix+"/", server.limit(newDavHandler(ctx, fileWatcher, access, versions)))
+
+	mux.Handle("/status", &statusHandler{
+		context:     ctx,
+		server:      server,
+		fileWatcher: fileWatcher,
+		access:      access,
+	})
+
+	mux.Handle("/shares", &shareHandler{
+		context:     ctx,
+		fileWatcher: fileWatcher,
+		access:      access,
 	})
 
 	server.Server.Handler = mux
 	return server
 }
+
+// SetLimits throttles the transfers of new connections, and of all of them
+// together.
+func (s *SyncServer) SetLimits(limits Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limits = limits
+	s.upload = NewLimiter(limits.Upload)
+	s.download = NewLimiter(limits.Download)
+}
+
+// Bandwidth returns the bandwidth limits now.
+func (s *SyncServer) Bandwidth() BandwidthStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var now = time.Now()
+	return BandwidthStatus{
+		Upload:       s.upload.Rate(),
+		Download:     s.download.Rate(),
+		ConnUpload:   s.limits.ConnUpload.At(now),
+		ConnDownload: s.limits.ConnDownload.At(now),
+	}
+}
+
+// limit throttles the request and response bodies of h to the limits of the
+// server and of the connection.
+func (s *SyncServer) limit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		var uploads, downloads = []*Limiter{s.upload}, []*Limiter{s.download}
+		s.mu.Unlock()
+
+		if conn, ok := r.Context().Value(connLimitersKey{}).(*connLimiters); ok {
+			uploads = append(uploads, conn.upload)
+			downloads = append(downloads, conn.download)
+		}
+
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{limitReader(r.Context(), r.Body, uploads...), r.Body}
+		h.ServeHTTP(&limitedResponseWriter{ResponseWriter: w, ctx: r.Context(), limiters: downloads}, r)
+	})
+}
+
+func (s *SyncServer) addConnection(conn *SyncConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = struct{}{}
+}
+
+func (s *SyncServer) removeConnection(conn *SyncConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// Connections returns the clients currently connected.
+func (s *SyncServer) Connections() []*SyncConnection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var conns []*SyncConnection
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
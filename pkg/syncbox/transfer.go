@@ -0,0 +1,345 @@
+package syncbox
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+)
+
+const (
+	// maxAttempts is how many times a failed transfer is tried, waiting
+	// twice as long as before between attempts starting at retryDelay.
+	maxAttempts = 5
+	retryDelay  = time.Second
+)
+
+// transfer is an upload or a download of a file, queued or running.
+type transfer struct {
+	// done are the bytes moved by the running attempt, updated atomically
+	done    int64
+	file    File
+	order   int64
+	attempt int
+	index   int
+	ctx     context.Context
+	cancel  context.CancelFunc
+	active  bool
+	started time.Time
+	err     error
+}
+
+// TransferStatus is the progress of a transfer, Rate in bytes per second and
+// ETA in seconds, zero if unknown.
+type TransferStatus struct {
+	Name    string `json:"name"`
+	Action  Action `json:"action"`
+	Size    int64  `json:"size"`
+	Done    int64  `json:"done"`
+	Rate    int64  `json:"rate"`
+	ETA     int64  `json:"eta"`
+	Attempt int    `json:"attempt,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// must hold the lock of the Transfers
+func (t *transfer) status(now time.Time) TransferStatus {
+	var status = TransferStatus{
+		Name:    t.file.FullName(),
+		Action:  t.file.Action,
+		Size:    t.file.Size,
+		Attempt: t.attempt,
+	}
+
+	if t.err != nil {
+		status.Error = t.err.Error()
+	}
+
+	if !t.active {
+		return status
+	}
+
+	// uploads count the form around the content too
+	status.Done = atomic.LoadInt64(&t.done)
+	if status.Done > status.Size {
+		status.Done = status.Size
+	}
+
+	if elapsed := now.Sub(t.started).Seconds(); elapsed > 0 {
+		status.Rate = int64(float64(status.Done) / elapsed)
+	}
+
+	if status.Rate > 0 {
+		status.ETA = (status.Size - status.Done + status.Rate - 1) / status.Rate
+	}
+
+	return status
+}
+
+type transferKey struct{}
+
+type countingReader struct {
+	r io.Reader
+	t *transfer
+}
+
+// countReader counts what is read from r as done by the transfer running
+// with ctx, if any.
+func countReader(ctx context.Context, r io.Reader) io.Reader {
+	t, ok := ctx.Value(transferKey{}).(*transfer)
+	if !ok {
+		return r
+	}
+
+	return &countingReader{r: r, t: t}
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(&r.t.done, int64(n))
+	return n, err
+}
+
+// transferQueue is a heap of transfers, the smallest files first and those
+// of equal size in the order they were queued.
+type transferQueue []*transfer
+
+func (q transferQueue) Len() int { return len(q) }
+
+func (q transferQueue) Less(i, j int) bool {
+	if q[i].file.Size != q[j].file.Size {
+		return q[i].file.Size < q[j].file.Size
+	}
+
+	return q[i].order < q[j].order
+}
+
+func (q transferQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *transferQueue) Push(x interface{}) {
+	var t = x.(*transfer)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *transferQueue) Pop() interface{} {
+	var old = *q
+	var t = old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*q = old[:len(old)-1]
+	return t
+}
+
+// Transfers runs uploads and downloads on a number of workers. A file queued
+// again replaces the transfer queued or running for it, and failed transfers
+// are retried with backoff.
+type Transfers struct {
+	mu    sync.Mutex
+	queue transferQueue
+	files map[string]*transfer
+	// failed are the transfers given up on, until the file is queued again
+	failed  map[string]*transfer
+	order   int64
+	workers int
+	wake    chan struct{}
+	run     func(ctx context.Context, file File) error
+}
+
+// NewTransfers runs transfers with run, which is canceled by ctx when the
+// file is queued again.
+func NewTransfers(workers int, run func(ctx context.Context, file File) error) *Transfers {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &Transfers{
+		files:   make(map[string]*transfer),
+		failed:  make(map[string]*transfer),
+		workers: workers,
+		wake:    make(chan struct{}, 1),
+		run:     run,
+	}
+}
+
+// Add queues the transfer of file by its action, in place of the one queued or
+// running for the same file.
+func (q *Transfers) Add(file File) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var key = file.FullName()
+	if t, ok := q.files[key]; ok {
+		q.drop(t)
+	}
+	delete(q.failed, key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.order++
+	var t = &transfer{file: file, order: q.order, ctx: ctx, cancel: cancel}
+	q.files[key] = t
+	heap.Push(&q.queue, t)
+	q.signal()
+}
+
+// Cancel stops the transfers of fullName and of everything under it.
+func (q *Transfers) Cancel(fullName string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for key, t := range q.files {
+		if key == fullName || under(key, fullName) {
+			q.drop(t)
+		}
+	}
+
+	for key := range q.failed {
+		if key == fullName || under(key, fullName) {
+			delete(q.failed, key)
+		}
+	}
+}
+
+// Status returns the transfers running, the ones waiting to run or for a
+// retry, and the ones given up on, each by name.
+func (q *Transfers) Status() (active, queued, failed []TransferStatus) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var now = time.Now()
+	active, queued, failed = []TransferStatus{}, []TransferStatus{}, []TransferStatus{}
+	for _, t := range q.files {
+		if t.active {
+			active = append(active, t.status(now))
+		} else {
+			queued = append(queued, t.status(now))
+		}
+	}
+
+	for _, t := range q.failed {
+		failed = append(failed, t.status(now))
+	}
+
+	for _, list := range [][]TransferStatus{active, queued, failed} {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Name < list[j].Name
+		})
+	}
+
+	return active, queued, failed
+}
+
+// drop cancels t and takes it out of the queue.
+//
+// must hold the lock
+func (q *Transfers) drop(t *transfer) {
+	t.cancel()
+	if t.index >= 0 && t.index < len(q.queue) && q.queue[t.index] == t {
+		heap.Remove(&q.queue, t.index)
+	}
+
+	if q.files[t.file.FullName()] == t {
+		delete(q.files, t.file.FullName())
+	}
+}
+
+// must hold the lock
+func (q *Transfers) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the workers, which stop when ctx is done.
+func (q *Transfers) Run(ctx context.Context) {
+	for i := 0; i < q.workers; i++ {
+		go q.work(ctx)
+	}
+}
+
+func (q *Transfers) work(ctx context.Context) {
+	for {
+		t, ok := q.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.wake:
+			}
+			continue
+		}
+
+		var err = q.run(context.WithValue(t.ctx, transferKey{}, t), t.file)
+		q.finish(t, err)
+	}
+}
+
+// next takes the first transfer off the queue, and passes the wake up on to
+// another worker if there are more.
+func (q *Transfers) next() (*transfer, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.queue) == 0 {
+		return nil, false
+	}
+
+	var t = heap.Pop(&q.queue).(*transfer)
+	if len(q.queue) > 0 {
+		q.signal()
+	}
+
+	t.active = true
+	t.started = time.Now()
+	atomic.StoreInt64(&t.done, 0)
+
+	return t, true
+}
+
+// finish forgets a done transfer, or queues it again after a while if it
+// failed.
+func (q *Transfers) finish(t *transfer, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var key = t.file.FullName()
+	t.active = false
+	if q.files[key] != t {
+		// replaced or canceled meanwhile
+		return
+	}
+
+	t.attempt++
+	t.err = err
+	if err == nil || t.attempt >= maxAttempts {
+		if err != nil {
+			log.WithError(err).Errorf("failed to %s %s, giving up", t.file.Action, key)
+			q.failed[key] = t
+		}
+		t.cancel()
+		delete(q.files, key)
+		return
+	}
+
+	var delay = retryDelay << uint(t.attempt-1)
+	log.WithError(err).Warnf("failed to %s %s, retrying in %s", t.file.Action, key, delay)
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		if q.files[key] == t && t.ctx.Err() == nil {
+			heap.Push(&q.queue, t)
+			q.signal()
+		}
+	})
+}
@@ -1,57 +1,307 @@
 package syncbox
 
 import (
+	"compress/gzip"
 	"context"
-	"fmt"
+	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
 
 	"github.com/apex/log"
 )
 
+type UploadResponse struct {
+	Seq      int64  `json:"seq"`
+	Checksum string `json:"checksum"`
+}
+
 type uploadHandler struct {
 	context     context.Context
 	fileWatcher *FileWatcher
+	access      *Access
+	versions    *VersionStore
 }
 
+// ServeHTTP reads the form fields before the file part, so that permissions
+// and quotas are checked against the announced size before any content is
+// written.
 func (u *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		http.NotFound(w, r)
 		return
 	}
 
-	err := r.ParseMultipartForm(5 * 1024 * 1024)
+	user, ok := u.access.Authenticate(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		r.Body = zr
+	}
+
+	reader, err := r.MultipartReader()
 	if err != nil {
 		log.WithError(err).Error("failed to parse")
-		//TODO: handle http response
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	file, _, err := r.FormFile("file")
+
+	var fields = make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF && fields["dir"] == "true" {
+			u.saveDir(w, user, fields)
+			return
+		}
+		if err == io.EOF && fields["link"] != "" {
+			u.saveLink(w, user, fields)
+			return
+		}
+		if err == io.EOF {
+			http.Error(w, "missing file", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("failed to read part")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() == "file" {
+			u.saveFile(w, user, fields, part)
+			return
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, 4096))
+		if err != nil {
+			log.WithError(err).Error("failed to read field")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fields[part.FormName()] = string(value)
+	}
+}
+
+func (u *uploadHandler) saveFile(w http.ResponseWriter, user string, fields map[string]string, file io.Reader) {
+	size, err := strconv.ParseInt(fields["size"], 10, 64)
 	if err != nil {
-		log.WithError(err).Error("failed to read file")
-		//TODO: handle http response
+		http.Error(w, "missing size", http.StatusBadRequest)
+		return
+	}
+
+	fullName, ok := u.fullName(w, fields)
+	if !ok {
+		return
+	}
+
+	if !u.access.Permission(user, fullName).CanWrite() {
+		http.Error(w, "read-only folder", http.StatusForbidden)
+		return
+	}
+
+	if err := u.access.CheckQuota(u.fileWatcher, user, fullName, size); err != nil {
+		http.Error(w, err.Error(), StatusQuotaExceeded)
 		return
 	}
-	defer file.Close()
-	var fullPath = fmt.Sprintf("%s%s", u.fileWatcher.path, r.FormValue("path"))
-	err = os.MkdirAll(fullPath, 0755)
+
+	if err := u.access.Claim(user, fullName); err != nil {
+		log.WithError(err).Error("failed to claim folder")
+	}
+
+	if err := u.versions.Archive(fullName); err != nil {
+		log.WithError(err).Error("failed to archive version")
+	}
+
+	var filepath = u.fileWatcher.path + fullName
+	err = os.MkdirAll(path.Dir(filepath), 0755)
 	if err != nil {
 		log.WithError(err).Error("failed to read file")
-		//TODO: handle http response
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// written aside and moved in place once complete, so that scans never
+	// index a partial upload
+	dir, err := ensureStateDir(u.fileWatcher.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	var filepath = fmt.Sprintf("%s%s", fullPath, r.FormValue("filename"))
-	f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE, 0666)
+	f, err := ioutil.TempFile(dir, "upload-*")
 	if err != nil {
 		log.WithError(err).Error("failed to create file")
-		//TODO: handle http response
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	// never write more than announced, the quota was checked against it
+	written, err := io.Copy(f, io.LimitReader(file, size+1))
+	if err != nil {
+		f.Close()
+		log.WithError(err).Error("failed to write file")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if written > size {
+		f.Close()
+		http.Error(w, "file is larger than announced", http.StatusBadRequest)
+		return
+	}
+
+	if err := f.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if attrs, ok := parseXattrs(fields); ok && u.fileWatcher.Xattrs() {
+		if err := applyXattrs(f.Name(), attrs); err != nil {
+			log.WithError(err).Error("failed to apply extended attributes")
+		}
+	}
+
+	mode, modTime := parseMeta(fields)
+	if mode == 0 {
+		// temp files are private, keep the mode of the file replaced
+		mode = 0644
+		if info, err := os.Stat(filepath); err == nil {
+			mode = info.Mode().Perm()
+		}
+	}
+	if err := applyMeta(f.Name(), mode, modTime); err != nil {
+		log.WithError(err).Error("failed to apply mode and mtime")
+	}
+
+	if err := os.Rename(f.Name(), filepath); err != nil {
+		log.WithError(err).Error("failed to move file in place")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer f.Close()
-	io.Copy(f, file)
 
-	//TODO: handle http response
-	return
+	u.respond(w, fullName)
+}
+
+// saveDir creates a directory, sent as a form with the dir field and without
+// a file.
+func (u *uploadHandler) saveDir(w http.ResponseWriter, user string, fields map[string]string) {
+	fullName, ok := u.fullName(w, fields)
+	if !ok {
+		return
+	}
+
+	if !u.access.Permission(user, fullName+"/").CanWrite() {
+		http.Error(w, "read-only folder", http.StatusForbidden)
+		return
+	}
+
+	if isLink(u.fileWatcher.path + fullName) {
+		http.Error(w, "a link is in the way", http.StatusConflict)
+		return
+	}
+
+	if err := u.access.Claim(user, fullName+"/"); err != nil {
+		log.WithError(err).Error("failed to claim folder")
+	}
+
+	if err := os.MkdirAll(u.fileWatcher.path+fullName, 0755); err != nil {
+		log.WithError(err).Error("failed to create directory")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	mode, _ := parseMeta(fields)
+	if err := applyMeta(u.fileWatcher.path+fullName, mode, 0); err != nil {
+		log.WithError(err).Error("failed to apply mode")
+	}
+
+	u.respond(w, fullName)
+}
+
+// saveLink creates a link, sent as a form with the link field of its target
+// and without a file.
+func (u *uploadHandler) saveLink(w http.ResponseWriter, user string, fields map[string]string) {
+	fullName, ok := u.fullName(w, fields)
+	if !ok {
+		return
+	}
+
+	if u.fileWatcher.SymlinkPolicy() != SymlinkLink {
+		http.Error(w, "links are not synced", http.StatusBadRequest)
+		return
+	}
+
+	if !linkWithin(fullName, fields["link"]) {
+		http.Error(w, "links must point within the root", http.StatusBadRequest)
+		return
+	}
+
+	if !u.access.Permission(user, fullName).CanWrite() {
+		http.Error(w, "read-only folder", http.StatusForbidden)
+		return
+	}
+
+	if err := u.access.Claim(user, fullName); err != nil {
+		log.WithError(err).Error("failed to claim folder")
+	}
+
+	if err := createLink(u.fileWatcher.path+fullName, fields["link"]); err != nil {
+		log.WithError(err).Error("failed to create link")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	u.respond(w, fullName)
+}
+
+// fullName returns the cleaned name of the path and filename fields, and
+// answers a bad request for names outside the synced files.
+func (u *uploadHandler) fullName(w http.ResponseWriter, fields map[string]string) (string, bool) {
+	fullName, ok := cleanName(fields["path"] + "/" + fields["filename"])
+	if !ok {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return "", false
+	}
+
+	if throughLink(u.fileWatcher.path, fullName) {
+		http.Error(w, "the path goes through a link", http.StatusForbidden)
+		return "", false
+	}
+
+	return fullName, true
+}
+
+// parseMeta reads the optional mode, in octal, and mtime, in unix
+// nanoseconds, fields. Missing ones are zero.
+func parseMeta(fields map[string]string) (os.FileMode, int64) {
+	mode, _ := strconv.ParseUint(fields["mode"], 8, 32)
+	modTime, _ := strconv.ParseInt(fields["mtime"], 10, 64)
+	return os.FileMode(mode).Perm(), modTime
+}
+
+func (u *uploadHandler) respond(w http.ResponseWriter, fullName string) {
+	// index the file right away, so that the client learns its sequence
+	if err := u.fileWatcher.WalkDir(); err != nil {
+		log.WithError(err).Error("failed to scan after upload")
+	}
+
+	uploaded, _ := u.fileWatcher.Get(fullName)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UploadResponse{
+		Seq:      uploaded.Seq,
+		Checksum: uploaded.Checksum,
+	})
 }
@@ -0,0 +1,144 @@
+package syncbox
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is an earlier content of a file, kept before it was overwritten or
+// deleted on the server.
+type Version struct {
+	ID      string    `json:"id"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// VersionStore keeps the versions of a file under
+// <root>/.syncbox/versions/<full name>/<unix nano>.
+type VersionStore struct {
+	root string
+	dir  string
+}
+
+func NewVersionStore(root string) (*VersionStore, error) {
+	dir, err := ensureStateDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VersionStore{
+		root: root,
+		dir:  dir + "/versions",
+	}, nil
+}
+
+// Archive copies the current content of fullName into a new version, it does
+// nothing if the file does not exist or is not a regular file, links are never
+// followed.
+func (v *VersionStore) Archive(fullName string) error {
+	info, err := os.Lstat(fmt.Sprintf("%s%s", v.root, fullName))
+	if os.IsNotExist(err) || err == nil && !info.Mode().IsRegular() || throughLink(v.root, fullName) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(fmt.Sprintf("%s%s", v.root, fullName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var dir = v.dir + path.Clean("/"+fullName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(fmt.Sprintf("%s/%d", dir, time.Now().UnixNano()))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// ArchiveTree archives fullName, or every regular file under it if it is a
+// directory, before it is removed. Links are neither archived nor followed.
+func (v *VersionStore) ArchiveTree(fullName string) error {
+	var root = v.root + path.Clean("/"+fullName)
+	if throughLink(v.root, fullName) {
+		return nil
+	}
+
+	return filepath.Walk(root, func(walked string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && info.Name() == StateDir {
+			return filepath.SkipDir
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		return v.Archive(strings.TrimPrefix(walked, v.root))
+	})
+}
+
+// List returns the versions of fullName, newest first.
+func (v *VersionStore) List(fullName string) ([]Version, error) {
+	infos, err := ioutil.ReadDir(v.dir + path.Clean("/"+fullName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		versions = append(versions, Version{
+			ID:      info.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID > versions[j].ID
+	})
+
+	return versions, nil
+}
+
+// Open returns the content of a version of fullName.
+func (v *VersionStore) Open(fullName string, id string) (*os.File, error) {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	return os.Open(v.dir + path.Clean("/"+fullName) + "/" + id)
+}
@@ -0,0 +1,425 @@
+package syncbox
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+)
+
+var webTemplate = template.Must(template.New("web").Parse(`{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<title>syncbox {{.Dir}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.3em 1em; text-align: left; }
+tr:nth-child(even) { background: #f4f4f4; }
+code { font-size: 0.8em; }
+form { display: inline; }
+</style>
+</head>
+<body>
+{{end}}
+{{define "footer"}}</body>
+</html>
+{{end}}
+{{define "list"}}{{template "header" .}}
+<h1>{{.Dir}}</h1>
+{{if ne .Dir "/"}}<p><a href="/web/?dir={{.Parent}}">..</a></p>{{end}}
+<table>
+<tr><th>name</th><th>size</th><th>modified</th><th>checksum</th><th></th></tr>
+{{range .Entries}}<tr>
+{{if .IsDir}}<td><a href="/web/?dir={{.FullName}}">{{.Name}}/</a></td><td></td><td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td><td></td><td></td>
+{{else}}<td><a href="/web/download?path={{.FullName}}">{{.Name}}</a></td>
+<td>{{.Size}}</td>
+<td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td>
+<td><code>{{.Checksum}}</code></td>
+<td><a href="/web/history?path={{.FullName}}">history</a>
+{{if $.Writable}}<form method="post" action="/web/delete"><input type="hidden" name="path" value="{{.FullName}}"><input type="hidden" name="token" value="{{$.Token}}"><button>delete</button></form>{{end}}</td>
+{{end}}</tr>
+{{end}}</table>
+{{if .Writable}}<form method="post" action="/web/upload" enctype="multipart/form-data">
+<input type="hidden" name="dir" value="{{.Dir}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="file" name="file">
+<button>upload</button>
+</form>{{end}}
+{{template "footer" .}}{{end}}
+{{define "history"}}{{template "header" .}}
+<h1>{{.Dir}}</h1>
+<p><a href="/web/?dir={{.Parent}}">back</a></p>
+<table>
+<tr><th>version</th><th>size</th><th>modified</th></tr>
+{{range .Versions}}<tr>
+<td><a href="/web/version?path={{$.Dir}}&amp;v={{.ID}}">{{.ID}}</a></td>
+<td>{{.Size}}</td>
+<td>{{.ModTime.Format "2006-01-02 15:04:05"}}</td>
+</tr>
+{{end}}</table>
+{{template "footer" .}}{{end}}
+`))
+
+type webEntry struct {
+	Name     string
+	FullName string
+	IsDir    bool
+	Size     int64
+	ModTime  time.Time
+	Checksum string
+}
+
+type webPage struct {
+	Dir      string
+	Parent   string
+	Writable bool
+	Token    string
+	Entries  []webEntry
+	Versions []Version
+}
+
+// webHandler serves a browser interface under /web/ to browse, download,
+// upload and delete files, authenticated with the same users as the clients.
+type webHandler struct {
+	context     context.Context
+	fileWatcher *FileWatcher
+	access      *Access
+	versions    *VersionStore
+	// secret signs the tokens of the forms, it changes on every start
+	secret []byte
+}
+
+func newWebHandler(ctx context.Context, fileWatcher *FileWatcher, access *Access, versions *VersionStore) *webHandler {
+	var secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		// nothing is safe without randomness
+		panic(err)
+	}
+
+	return &webHandler{
+		context:     ctx,
+		fileWatcher: fileWatcher,
+		access:      access,
+		versions:    versions,
+		secret:      secret,
+	}
+}
+
+// token is what the forms of user carry, browsers send the credentials of the
+// user along with forms posted by any site, but only pages of the server know
+// the token.
+func (h *webHandler) token(user string) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkPost refuses requests other than a POST with the token of user.
+func (h *webHandler) checkPost(w http.ResponseWriter, r *http.Request, user string) bool {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return false
+	}
+
+	if !hmac.Equal([]byte(r.FormValue("token")), []byte(h.token(user))) {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func (h *webHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.access.Authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="syncbox"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/web") {
+	case "/", "":
+		h.list(w, r, user)
+	case "/download":
+		h.download(w, r, user)
+	case "/history":
+		h.history(w, r, user)
+	case "/version":
+		h.version(w, r, user)
+	case "/upload":
+		h.upload(w, r, user)
+	case "/delete":
+		h.delete(w, r, user)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// name cleans a path of a request, and refuses the state directory and links
+// as well as what is reached through them, which could lead out of the
+// folders of the user.
+func (h *webHandler) name(value string) (string, bool) {
+	fullName, ok := cleanName(value)
+	if !ok || throughLink(h.fileWatcher.path, fullName) || isLink(h.fileWatcher.path+fullName) {
+		return "", false
+	}
+
+	return fullName, true
+}
+
+func (h *webHandler) list(w http.ResponseWriter, r *http.Request, user string) {
+	var dir = path.Clean("/" + r.URL.Query().Get("dir"))
+	if _, ok := h.name(dir); !ok && dir != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.access.Permission(user, dir+"/").CanRead() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	infos, err := ioutil.ReadDir(h.fileWatcher.path + dir)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var page = webPage{
+		Dir:      dir,
+		Parent:   path.Dir(dir),
+		Writable: h.access.Permission(user, dir+"/").CanWrite(),
+		Token:    h.token(user),
+	}
+
+	for _, info := range infos {
+		if info.Name() == StateDir || info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+
+		var fullName = path.Join(dir, info.Name())
+		if !h.access.Permission(user, fullName+"/").CanRead() {
+			continue
+		}
+
+		var entry = webEntry{
+			Name:     info.Name(),
+			FullName: fullName,
+			IsDir:    info.IsDir(),
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+		}
+
+		if file, ok := h.fileWatcher.Get(fullName); ok {
+			entry.Checksum = file.Checksum
+		}
+
+		page.Entries = append(page.Entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := webTemplate.ExecuteTemplate(w, "list", page); err != nil {
+		log.WithError(err).Error("failed to render")
+	}
+}
+
+func (h *webHandler) download(w http.ResponseWriter, r *http.Request, user string) {
+	fullName, ok := h.name(r.URL.Query().Get("path"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.access.Permission(user, fullName).CanRead() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	dir, name := path.Split(fullName)
+	var file = File{Path: dir, Name: name}
+	if indexed, ok := h.fileWatcher.Get(fullName); ok {
+		file = indexed
+	}
+
+	serveFile(w, r, h.fileWatcher.path, file)
+}
+
+func (h *webHandler) history(w http.ResponseWriter, r *http.Request, user string) {
+	fullName, ok := h.name(r.URL.Query().Get("path"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.access.Permission(user, fullName).CanRead() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	versions, err := h.versions.List(fullName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := webTemplate.ExecuteTemplate(w, "history", webPage{
+		Dir:      fullName,
+		Parent:   path.Dir(fullName),
+		Versions: versions,
+	}); err != nil {
+		log.WithError(err).Error("failed to render")
+	}
+}
+
+func (h *webHandler) version(w http.ResponseWriter, r *http.Request, user string) {
+	fullName, ok := h.name(r.URL.Query().Get("path"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !h.access.Permission(user, fullName).CanRead() {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	f, err := h.versions.Open(fullName, r.URL.Query().Get("v"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var name = path.Base(fullName)
+	w.Header().Set("Content-Disposition", "attachment; filename="+name)
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+func (h *webHandler) upload(w http.ResponseWriter, r *http.Request, user string) {
+	if !h.checkPost(w, r, user) {
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	var dir = path.Clean("/" + r.FormValue("dir"))
+	fullName, ok := h.name(path.Join(dir, path.Base(header.Filename)))
+	if !ok {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !h.access.Permission(user, fullName).CanWrite() {
+		http.Error(w, "read-only folder", http.StatusForbidden)
+		return
+	}
+
+	if err := h.access.CheckQuota(h.fileWatcher, user, fullName, header.Size); err != nil {
+		http.Error(w, err.Error(), StatusQuotaExceeded)
+		return
+	}
+
+	if err := h.access.Claim(user, fullName); err != nil {
+		log.WithError(err).Error("failed to claim folder")
+	}
+
+	if err := h.versions.Archive(fullName); err != nil {
+		log.WithError(err).Error("failed to archive version")
+	}
+
+	// written aside and moved in place once complete, so that a failed
+	// upload leaves the file as it was, see uploadHandler.saveFile
+	stateDir, err := ensureStateDir(h.fileWatcher.path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f, err := ioutil.TempFile(stateDir, "upload-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, file); err != nil {
+		f.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := f.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// temp files are private, keep the mode of the file replaced
+	var mode os.FileMode = 0644
+	if info, err := os.Stat(h.fileWatcher.path + fullName); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		log.WithError(err).Error("failed to apply mode")
+	}
+
+	if err := os.Rename(f.Name(), h.fileWatcher.path+fullName); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/web/?dir="+url.QueryEscape(dir), http.StatusSeeOther)
+}
+
+func (h *webHandler) delete(w http.ResponseWriter, r *http.Request, user string) {
+	if !h.checkPost(w, r, user) {
+		return
+	}
+
+	fullName, ok := h.name(r.FormValue("path"))
+	if !ok {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	if !h.access.Permission(user, fullName).CanWrite() {
+		http.Error(w, "read-only folder", http.StatusForbidden)
+		return
+	}
+
+	if err := h.versions.Archive(fullName); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.Remove(h.fileWatcher.path + fullName); err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/web/?dir="+url.QueryEscape(path.Dir(fullName)), http.StatusSeeOther)
+}
@@ -0,0 +1,71 @@
+package syncbox
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// xattrPrefix is the namespace of extended attributes synced, system ones
+// like SELinux labels are left to each machine.
+const xattrPrefix = "user."
+
+// SetXattrs turns on syncing extended attributes, before the first scan.
+func (f *FileWatcher) SetXattrs(enabled bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.xattrs = enabled
+}
+
+// Xattrs tells whether the watcher syncs extended attributes.
+func (f *FileWatcher) Xattrs() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.xattrs
+}
+
+// xattrChecksum hashes attributes in name order with the algorithm of the
+// index, so that every set of attributes, none included, has a checksum.
+func xattrChecksum(attrs map[string][]byte, algorithm HashAlgorithm) string {
+	var names = make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := algorithm.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\x00%x\n", name, attrs[name])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// readXattrs reads the attributes of the file at fullPath with their
+// checksum, the checksum is empty where attributes are not supported.
+func readXattrs(fullPath string, algorithm HashAlgorithm) (map[string][]byte, string, error) {
+	attrs, err := listXattrs(fullPath)
+	if err != nil || attrs == nil {
+		return nil, "", err
+	}
+
+	return attrs, xattrChecksum(attrs, algorithm), nil
+}
+
+// parseXattrs decodes the xattrs field of an upload, nil if it was not sent.
+func parseXattrs(fields map[string]string) (map[string][]byte, bool) {
+	value, ok := fields["xattrs"]
+	if !ok {
+		return nil, false
+	}
+
+	var attrs map[string][]byte
+	if err := json.Unmarshal([]byte(value), &attrs); err != nil {
+		return nil, false
+	}
+
+	return attrs, true
+}
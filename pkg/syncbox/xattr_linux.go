@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package syncbox
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+)
+
+// listXattrs returns the user attributes of the file at fullPath, or nil if
+// the filesystem does not support them.
+func listXattrs(fullPath string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(fullPath, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs = make(map[string][]byte)
+	if size == 0 {
+		return attrs, nil
+	}
+
+	var buf = make([]byte, size)
+	if size, err = syscall.Listxattr(fullPath, buf); err != nil {
+		return nil, err
+	}
+
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if !strings.HasPrefix(string(name), xattrPrefix) {
+			continue
+		}
+
+		value, err := getXattr(fullPath, string(name))
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value
+	}
+
+	return attrs, nil
+}
+
+func getXattr(fullPath string, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(fullPath, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var value = make([]byte, size)
+	if size, err = syscall.Getxattr(fullPath, name, value); err != nil {
+		return nil, err
+	}
+
+	return value[:size], nil
+}
+
+// applyXattrs sets the user attributes of the file at fullPath to attrs, and
+// removes the ones not in attrs.
+func applyXattrs(fullPath string, attrs map[string][]byte) error {
+	current, err := listXattrs(fullPath)
+	if err != nil || current == nil {
+		return err
+	}
+
+	for name := range current {
+		if _, ok := attrs[name]; !ok {
+			if err := syscall.Removexattr(fullPath, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, value := range attrs {
+		if old, ok := current[name]; !strings.HasPrefix(name, xattrPrefix) || ok && bytes.Equal(old, value) {
+			continue
+		}
+
+		if err := syscall.Setxattr(fullPath, name, value, 0); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package syncbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestXattrsRoundTrip(t *testing.T) {
+	var fullPath = filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(fullPath, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := syscall.Setxattr(fullPath, "user.probe", []byte("x"), 0); err != nil {
+		t.Skipf("extended attributes are not supported: %v", err)
+	}
+
+	var attrs = map[string][]byte{
+		"user.color": []byte("red"),
+		"user.bin":   {0, 1, 2},
+	}
+	if err := applyXattrs(fullPath, attrs); err != nil {
+		t.Fatal(err)
+	}
+
+	got, sum, err := readXattrs(fullPath, HashSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(attrs) {
+		t.Fatalf("got attributes %v, want %v", got, attrs)
+	}
+	for name, value := range attrs {
+		if !bytes.Equal(got[name], value) {
+			t.Errorf("attribute %s is %q, want %q", name, got[name], value)
+		}
+	}
+
+	if want := xattrChecksum(attrs, HashSHA256); sum != want {
+		t.Errorf("checksum is %s, want %s", sum, want)
+	}
+
+	if md5 := xattrChecksum(attrs, HashMD5); sum == md5 {
+		t.Errorf("checksum with sha256 is the one with md5")
+	}
+
+	if err := applyXattrs(fullPath, map[string][]byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, sum, err = readXattrs(fullPath, HashSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 0 {
+		t.Errorf("attributes %v are left after removing them", got)
+	}
+	if want := xattrChecksum(nil, HashSHA256); sum != want {
+		t.Errorf("checksum without attributes is %s, want %s", sum, want)
+	}
+}
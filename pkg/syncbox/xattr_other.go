@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package syncbox
+
+// listXattrs reports extended attributes as unsupported off linux.
+func listXattrs(fullPath string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func applyXattrs(fullPath string, attrs map[string][]byte) error {
+	return nil
+}
@@ -60,6 +60,17 @@ func New(url string, requestHeader http.Header) *WebSocketClient {
 	}
 }
 
+// EnableCompression negotiates permessage-deflate with the server, before
+// connecting.
+func (c *WebSocketClient) EnableCompression() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var dialer = *c.Dialer
+	dialer.EnableCompression = true
+	c.Dialer = &dialer
+}
+
 func (c *WebSocketClient) setConn(conn *websocket.Conn) {
 	c.mu.Lock()
 	c.conn = conn